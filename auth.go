@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
@@ -38,6 +39,47 @@ func AuthRequired() gin.HandlerFunc {
 	}
 }
 
+/*
+OwnTracks HTTP mode sends basic auth, plus the user and device in the X-Limit-U and X-Limit-D headers
+*/
+func DeviceAuthRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, password, ok := c.Request.BasicAuth()
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="owntracks"`)
+			c.AbortWithStatus(401)
+			return
+		}
+		user := c.GetHeader("X-Limit-U")
+		if user == "" {
+			user = username
+		}
+		device := c.GetHeader("X-Limit-D")
+		if device == "" || user != username {
+			log.Printf("Rejecting OwnTracks HTTP publish for user=%v device=%v as %v", user, device, username)
+			c.AbortWithStatus(401)
+			return
+		}
+		if !validDeviceCredentials(configuration.OwntracksHTTPDevices, user, device, password) {
+			log.Printf("Invalid OwnTracks HTTP credentials for user=%v device=%v", user, device)
+			c.AbortWithStatus(401)
+			return
+		}
+		c.Set("owntracksUser", user)
+		c.Set("owntracksDevice", device)
+		c.Next()
+	}
+}
+
+func validDeviceCredentials(devices []OwntracksHTTPDevice, user string, device string, password string) bool {
+	for _, credential := range devices {
+		if credential.User == user && credential.Device == device && credential.Password != "" {
+			return subtle.ConstantTimeCompare([]byte(credential.Password), []byte(password)) == 1
+		}
+	}
+	return false
+}
+
 func OauthCallback(c *gin.Context) {
 	c.Request.ParseForm()
 	authCode := c.Request.Form.Get("code")
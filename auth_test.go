@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func deviceAuthTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	configuration.OwntracksHTTPDevices = []OwntracksHTTPDevice{{User: "growse", Device: "nexus5", Password: "parp"}}
+	router := gin.New()
+	router.POST("/where/pub", DeviceAuthRequired(), func(c *gin.Context) {
+		c.String(200, c.GetString("owntracksUser")+"/"+c.GetString("owntracksDevice"))
+	})
+	return router
+}
+
+func TestDeviceAuthWithValidCredentialsPassesUserAndDevice(t *testing.T) {
+	router := deviceAuthTestRouter()
+	request, _ := http.NewRequest("POST", "/where/pub", nil)
+	request.SetBasicAuth("growse", "parp")
+	request.Header.Set("X-Limit-U", "growse")
+	request.Header.Set("X-Limit-D", "nexus5")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, 200, response.Code)
+	assert.Equal(t, "growse/nexus5", response.Body.String())
+}
+
+func TestDeviceAuthWithWrongPasswordIsRejected(t *testing.T) {
+	router := deviceAuthTestRouter()
+	request, _ := http.NewRequest("POST", "/where/pub", nil)
+	request.SetBasicAuth("growse", "toot")
+	request.Header.Set("X-Limit-U", "growse")
+	request.Header.Set("X-Limit-D", "nexus5")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, 401, response.Code)
+}
+
+func TestDeviceAuthForAnotherUsersDeviceIsRejected(t *testing.T) {
+	router := deviceAuthTestRouter()
+	request, _ := http.NewRequest("POST", "/where/pub", nil)
+	request.SetBasicAuth("someoneelse", "parp")
+	request.Header.Set("X-Limit-U", "growse")
+	request.Header.Set("X-Limit-D", "nexus5")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, 401, response.Code)
+}
+
+func TestDeviceAuthWithoutCredentialsIsRejected(t *testing.T) {
+	router := deviceAuthTestRouter()
+	request, _ := http.NewRequest("POST", "/where/pub", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, 401, response.Code)
+}
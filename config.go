@@ -27,11 +27,49 @@ type Configuration struct {
 	MQTTURL                string `json:"mqttUrl"`
 	MQTTUsername           string `json:"mqttUsername"`
 	MQTTPassword           string `json:"mqttPassword"`
+	MQTTTopic              string `json:"mqttTopic"` // Needs to reach the /event, /waypoint etc. subtopics as well, hence # and not +/+
+	MQTTClientID           string `json:"mqttClientId"`
+	MQTTQoS                byte   `json:"mqttQos"`
+	MQTTCleanSession       bool   `json:"mqttCleanSession"`
+	MQTTStoreDir           string `json:"mqttStoreDir"`
+	MQTTCACertFile         string `json:"mqttCaCertFile"`
+	MQTTClientCertFile     string `json:"mqttClientCertFile"`
+	MQTTClientKeyFile      string `json:"mqttClientKeyFile"`
+	MQTTTLSServerName      string `json:"mqttTlsServerName"`
+	MQTTTLSInsecure        bool   `json:"mqttTlsInsecure"`
 	SearchIndexRoot        string
 	SearchPathPattern      string
 	AllowedAuthUsers       string
 	EnableGeocodingCrawler bool
+	GeocodingWorkers       int
+	GeocodingMaxAttempts   int
+	GeocodingRateLimit     float64 // Reverse geocoding requests per second
+	GeocodingCacheDays     int
+	GeocodingBackfillRate  float64 // Locations per second the backfill queues
+	GeocodingBatchSize     int
+	GeocodingSweepMinutes  int    // How often to look for locations that missed geocoding. Off (0) by default
+	GeocodingCacheDecimals int    // Decimal places of lat/lon that share a cache entry
+	GeocodingProvider      string // google, opencage, nominatim, photon or offline. Used for place search
+	ReverseGeocoder        string // Provider used to geocode locations
+	OfflineGeocoderPath    string // GeoJSON file or directory for the offline provider
 	OwntracksFrontendDir   string
+	OwntracksHTTPDevices   []OwntracksHTTPDevice
+	LocationRetryQueueDir  string
+	VisitMaxDistance       float64 // Metres a stay can wander from where it started
+	VisitMinMinutes        int
+	ImportBatchSize        int     // Locations per COPY when uploading history
+	MaxLocationAccuracy    float64 // Metres. Fixes less accurate than this are excluded, 0 keeps everything
+	MaxImpliedSpeed        float64 // km/h. Fixes we'd have had to go faster than this to reach are excluded
+}
+
+/*
+Credentials for a phone publishing in OwnTracks HTTP mode
+*/
+type OwntracksHTTPDevice struct {
+	User     string
+	Device   string
+	Password string
+	Friends  []string // Other users whose devices this one is sent. Its own user's other devices always are
 }
 
 func getConfiguration() *Configuration {
@@ -64,10 +102,30 @@ func getConfiguration() *Configuration {
 		MQTTURL:                "",
 		MQTTUsername:           "",
 		MQTTPassword:           "",
+		MQTTTopic:              "owntracks/#",
+		MQTTClientID:           "growselocator",
+		MQTTQoS:                1,
+		MQTTCleanSession:       false,
+		MQTTStoreDir:           "/var/lib/www-growse-com/mqttstore",
 		SearchIndexRoot:        "/var/www/growse-jekyll",
 		SearchPathPattern:      "\\d{4}/\\d{2}/\\d{2}/.+?\\.html$",
 		AllowedAuthUsers:       "growse@gmail.com",
 		OwntracksFrontendDir:   "/var/www/owntracks-frontend",
+		GeocodingWorkers:       2,
+		GeocodingMaxAttempts:   5,
+		GeocodingRateLimit:     1,
+		GeocodingCacheDays:     90,
+		GeocodingBackfillRate:  1,
+		GeocodingBatchSize:     100,
+		GeocodingSweepMinutes:  0,
+		GeocodingCacheDecimals: 4,
+		GeocodingProvider:      "opencage",
+		ReverseGeocoder:        "google",
+		OwntracksHTTPDevices:   []OwntracksHTTPDevice{},
+		LocationRetryQueueDir:  "/var/lib/www-growse-com/retryqueue",
+		VisitMaxDistance:       200,
+		VisitMinMinutes:        10,
+		ImportBatchSize:        1000,
 	}
 	err = viper.Unmarshal(&defaultConfig)
 	if err != nil {
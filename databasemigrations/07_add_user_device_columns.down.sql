@@ -0,0 +1,7 @@
+ALTER TABLE public.locations
+    DROP CONSTRAINT unique_device_timestamps;
+
+ALTER TABLE public.locations
+    ADD CONSTRAINT unique_device_timestamps UNIQUE (devicetimestamp);
+
+alter table locations drop column username, drop column device, drop column trackerid;
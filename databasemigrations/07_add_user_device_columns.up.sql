@@ -0,0 +1,11 @@
+alter table locations add column username varchar(64), add column device varchar(64), add column trackerid varchar(8);
+
+update locations set username = 'growse', device = 'nexus5' where username is null;
+
+alter table locations alter column username set not null, alter column device set not null;
+
+ALTER TABLE public.locations
+    DROP CONSTRAINT unique_device_timestamps;
+
+ALTER TABLE public.locations
+    ADD CONSTRAINT unique_device_timestamps UNIQUE (username, device, devicetimestamp);
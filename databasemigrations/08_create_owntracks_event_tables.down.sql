@@ -0,0 +1,4 @@
+DROP TABLE public.lwts;
+DROP TABLE public.cards;
+DROP TABLE public.waypoints;
+DROP TABLE public.transitions;
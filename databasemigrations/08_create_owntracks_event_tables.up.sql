@@ -0,0 +1,48 @@
+CREATE TABLE public.transitions (
+    id serial PRIMARY KEY,
+    "timestamp" timestamp with time zone NOT NULL,
+    devicetimestamp timestamp with time zone NOT NULL,
+    waypointtimestamp timestamp with time zone,
+    username varchar(64) NOT NULL,
+    device varchar(64) NOT NULL,
+    trackerid varchar(8),
+    event varchar(16) NOT NULL,
+    description text,
+    regionid varchar(64),
+    trigger varchar(1),
+    accuracy numeric(12,6),
+    point public.geography(Point,4326),
+    CONSTRAINT unique_transitions UNIQUE (username, device, devicetimestamp, event, description)
+);
+
+CREATE INDEX idx_transitions_devicetimestamp ON public.transitions USING btree (devicetimestamp);
+
+CREATE TABLE public.waypoints (
+    "timestamp" timestamp with time zone NOT NULL,
+    waypointtimestamp timestamp with time zone NOT NULL,
+    username varchar(64) NOT NULL,
+    device varchar(64) NOT NULL,
+    description text NOT NULL,
+    regionid varchar(64),
+    radius integer,
+    point public.geography(Point,4326),
+    PRIMARY KEY (username, device, waypointtimestamp)
+);
+
+CREATE TABLE public.cards (
+    "timestamp" timestamp with time zone NOT NULL,
+    username varchar(64) NOT NULL,
+    device varchar(64) NOT NULL,
+    trackerid varchar(8),
+    name text,
+    face text,
+    PRIMARY KEY (username, device)
+);
+
+CREATE TABLE public.lwts (
+    id serial PRIMARY KEY,
+    "timestamp" timestamp with time zone NOT NULL,
+    devicetimestamp timestamp with time zone NOT NULL,
+    username varchar(64) NOT NULL,
+    device varchar(64) NOT NULL
+);
@@ -0,0 +1,11 @@
+alter table locations
+    drop column raw,
+    drop column trigger,
+    drop column batterystatus,
+    drop column ssid,
+    drop column bssid,
+    drop column inregions,
+    drop column courseoverground,
+    drop column pressure,
+    drop column monitoringmode,
+    drop column topic;
@@ -0,0 +1,11 @@
+alter table locations
+    add column raw jsonb,
+    add column trigger varchar(1),
+    add column batterystatus smallint,
+    add column ssid varchar(64),
+    add column bssid varchar(64),
+    add column inregions text[],
+    add column courseoverground smallint,
+    add column pressure numeric(8,3),
+    add column monitoringmode smallint,
+    add column topic text;
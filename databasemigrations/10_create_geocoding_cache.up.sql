@@ -0,0 +1,7 @@
+CREATE TABLE public.geocodingcache (
+    key varchar(512) PRIMARY KEY,
+    created timestamp with time zone NOT NULL,
+    response jsonb NOT NULL
+);
+
+CREATE INDEX idx_geocodingcache_created ON public.geocodingcache USING btree (created);
@@ -0,0 +1,13 @@
+CREATE TABLE public.visits (
+    id bigserial PRIMARY KEY,
+    username varchar(64) NOT NULL,
+    device varchar(64) NOT NULL,
+    arrival timestamp with time zone NOT NULL,
+    departure timestamp with time zone NOT NULL,
+    point public.geography(Point,4326) NOT NULL,
+    pointcount integer NOT NULL,
+    geocoding jsonb,
+    CONSTRAINT unique_visits UNIQUE (username, device, arrival)
+);
+
+CREATE INDEX idx_visits_departure ON public.visits USING btree (departure);
@@ -0,0 +1,9 @@
+DROP TRIGGER locationstats_delete ON public.locations;
+DROP TRIGGER locationstats_update ON public.locations;
+DROP TRIGGER locationstats_insert ON public.locations;
+DROP FUNCTION public.locationstats_refresh();
+DROP TYPE public.locationstats_point;
+DROP FUNCTION public.locationstats_recompute(varchar, varchar, date);
+DROP TABLE public.locationstats_daily;
+DROP FUNCTION public.geocoding_locality(jsonb);
+DROP FUNCTION public.geocoding_country(jsonb);
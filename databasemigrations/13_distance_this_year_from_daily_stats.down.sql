@@ -0,0 +1,36 @@
+DROP VIEW public.locations_distance_this_year;
+
+CREATE MATERIALIZED VIEW public.locations_distance_this_year
+    TABLESPACE pg_default
+AS
+SELECT sum(a.distance) AS distance
+FROM ( SELECT st_distance(locations.point, lag(locations.point, 1, locations.point) OVER (ORDER BY locations.devicetimestamp)) AS distance
+       FROM locations
+       WHERE date_part('year'::text, date(timezone('UTC'::text, locations.devicetimestamp))::timestamp without time zone) = date_part('year'::text, now())) a
+WITH DATA;
+
+ALTER TABLE public.locations_distance_this_year
+    OWNER TO www_growse_com;
+
+CREATE UNIQUE INDEX idx_locations_distance_this_year
+    ON public.locations_distance_this_year USING btree
+        (distance ASC NULLS LAST)
+    TABLESPACE pg_default;
+
+CREATE FUNCTION public.location_update_distance_view()
+    RETURNS trigger
+    language plpgsql
+AS $$
+begin
+    refresh materialized view concurrently public.locations_distance_this_year;
+    return null;
+end
+$$;
+
+ALTER FUNCTION public.location_update_distance_view()
+    OWNER TO www_growse_com;
+
+create trigger refresh_mat_view
+    after insert or update or delete or truncate
+    on locations for each statement
+execute procedure public.location_update_distance_view();
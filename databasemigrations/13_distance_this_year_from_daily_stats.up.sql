@@ -0,0 +1,12 @@
+DROP TRIGGER refresh_mat_view ON public.locations;
+DROP FUNCTION public.location_update_distance_view();
+DROP MATERIALIZED VIEW public.locations_distance_this_year;
+
+-- locationstats_daily is kept up to date as locations change, so this only sums this year's days
+CREATE VIEW public.locations_distance_this_year AS
+SELECT coalesce(sum(locationstats_daily.distance), 0) AS distance
+FROM locationstats_daily
+WHERE date_part('year'::text, locationstats_daily.day) = date_part('year'::text, now());
+
+ALTER TABLE public.locations_distance_this_year
+    OWNER TO www_growse_com;
@@ -0,0 +1 @@
+alter table locations drop column source;
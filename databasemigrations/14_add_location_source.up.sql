@@ -0,0 +1 @@
+alter table locations add column source varchar(64);
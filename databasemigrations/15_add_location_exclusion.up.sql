@@ -0,0 +1,87 @@
+-- Fixes with silly accuracy or impossible speeds stay in the table but nothing reads them
+ALTER TABLE public.locations ADD COLUMN excluded boolean NOT NULL DEFAULT false, ADD COLUMN excludedreason varchar(32);
+
+-- Recompute one device's UTC day, leaving out excluded fixes. Each segment counts towards the day of its later point,
+-- as long as both points are in the same UTC year, so a year's distance matches summing the year's points in order
+CREATE OR REPLACE FUNCTION public.locationstats_recompute(p_username varchar, p_device varchar, p_day date)
+    RETURNS void
+    LANGUAGE plpgsql
+AS $$
+declare
+    daystart timestamp with time zone := p_day::timestamp at time zone 'UTC';
+    dayend timestamp with time zone := (p_day + 1)::timestamp at time zone 'UTC';
+    yearstart timestamp with time zone := date_trunc('year', p_day::timestamp) at time zone 'UTC';
+    segmentstart timestamp with time zone;
+begin
+    select coalesce(max(devicetimestamp), daystart) into segmentstart
+    from locations
+    where username = p_username and device = p_device and devicetimestamp >= yearstart and devicetimestamp < daystart
+      and not excluded;
+
+    delete from locationstats_daily where username = p_username and device = p_device and day = p_day;
+
+    insert into locationstats_daily (username, device, day, distance, activeseconds, maxaltitude, countries, places, points)
+    select p_username,
+           p_device,
+           p_day,
+           coalesce(sum(segmentdistance), 0),
+           coalesce(sum(segmentseconds) filter (where segmentseconds <= 900 and segmentdistance >= 0.5 * segmentseconds), 0),
+           max(altitude),
+           coalesce(array_agg(distinct geocoding_country(geocoding)) filter (where geocoding_country(geocoding) is not null), '{}'),
+           coalesce(array_agg(distinct geocoding_locality(geocoding)) filter (where geocoding_locality(geocoding) is not null), '{}'),
+           count(*)
+    from (
+        select devicetimestamp,
+               altitude,
+               geocoding,
+               st_distance(point, lag(point) over segments) as segmentdistance,
+               extract(epoch from devicetimestamp - lag(devicetimestamp) over segments) as segmentseconds
+        from locations
+        where username = p_username and device = p_device and devicetimestamp >= segmentstart and devicetimestamp < dayend
+          and not excluded
+        window segments as (order by devicetimestamp)
+    ) segments
+    where devicetimestamp >= daystart
+    having count(*) > 0;
+end
+$$;
+
+-- Changing a point changes its own day, and the day of the next included point after it through that point's segment
+CREATE OR REPLACE FUNCTION public.locationstats_refresh()
+    RETURNS trigger
+    LANGUAGE plpgsql
+AS $$
+declare
+    touched locationstats_point[];
+begin
+    if TG_OP = 'INSERT' then
+        touched := array(select (username, device, devicetimestamp)::locationstats_point from newrows);
+    elsif TG_OP = 'UPDATE' then
+        touched := array(select (username, device, devicetimestamp)::locationstats_point from newrows
+                         union
+                         select (username, device, devicetimestamp)::locationstats_point from oldrows);
+    else
+        touched := array(select (username, device, devicetimestamp)::locationstats_point from oldrows);
+    end if;
+
+    perform locationstats_recompute(days.username, days.device, days.day)
+    from (
+        select distinct points.username, points.device, (points.devicetimestamp at time zone 'UTC')::date as day
+        from unnest(touched) points
+        union
+        select points.username, points.device, (next.devicetimestamp at time zone 'UTC')::date
+        from unnest(touched) points
+        cross join lateral (
+            select devicetimestamp
+            from locations
+            where locations.username = points.username
+              and locations.device = points.device
+              and locations.devicetimestamp > points.devicetimestamp
+              and not locations.excluded
+            order by devicetimestamp
+            limit 1
+        ) next
+    ) days;
+    return null;
+end
+$$;
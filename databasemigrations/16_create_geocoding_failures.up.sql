@@ -0,0 +1,6 @@
+-- Locations the geocoding queue gave up on, so sweeps can stop retrying the ones that never work
+CREATE TABLE public.geocodingfailures (
+    locationid integer PRIMARY KEY REFERENCES public.locations (id) ON DELETE CASCADE,
+    attempts integer NOT NULL,
+    lastattempt timestamp with time zone NOT NULL
+);
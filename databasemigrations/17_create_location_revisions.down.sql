@@ -0,0 +1,6 @@
+DROP TRIGGER locationrevisions_delete ON public.locations;
+DROP TRIGGER locationrevisions_update ON public.locations;
+DROP TRIGGER locationrevisions_insert ON public.locations;
+DROP FUNCTION public.locationrevisions_bump();
+DROP TABLE public.locationrevisions;
+DROP SEQUENCE public.locationrevisions_seq;
@@ -0,0 +1,57 @@
+-- Bumped for a device whenever any of its locations are inserted, updated or deleted, so clients can tell cheaply
+-- whether what they have is still current
+CREATE SEQUENCE public.locationrevisions_seq;
+
+CREATE TABLE public.locationrevisions (
+    username varchar(64) NOT NULL,
+    device varchar(64) NOT NULL,
+    revision bigint NOT NULL,
+    PRIMARY KEY (username, device)
+);
+
+INSERT INTO public.locationrevisions (username, device, revision)
+SELECT username, device, nextval('public.locationrevisions_seq')
+FROM (SELECT DISTINCT username, device FROM public.locations) devices;
+
+CREATE OR REPLACE FUNCTION public.locationrevisions_bump()
+    RETURNS trigger
+    LANGUAGE plpgsql
+AS $$
+begin
+    if TG_OP = 'INSERT' then
+        insert into locationrevisions (username, device, revision)
+        select username, device, nextval('locationrevisions_seq')
+        from (select distinct username, device from newrows) devices
+        on conflict (username, device) do update set revision = excluded.revision;
+    elsif TG_OP = 'UPDATE' then
+        insert into locationrevisions (username, device, revision)
+        select username, device, nextval('locationrevisions_seq')
+        from (select username, device from newrows union select username, device from oldrows) devices
+        on conflict (username, device) do update set revision = excluded.revision;
+    else
+        insert into locationrevisions (username, device, revision)
+        select username, device, nextval('locationrevisions_seq')
+        from (select distinct username, device from oldrows) devices
+        on conflict (username, device) do update set revision = excluded.revision;
+    end if;
+    return null;
+end
+$$;
+
+CREATE TRIGGER locationrevisions_insert
+    AFTER INSERT ON public.locations
+    REFERENCING NEW TABLE AS newrows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE public.locationrevisions_bump();
+
+CREATE TRIGGER locationrevisions_update
+    AFTER UPDATE ON public.locations
+    REFERENCING OLD TABLE AS oldrows NEW TABLE AS newrows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE public.locationrevisions_bump();
+
+CREATE TRIGGER locationrevisions_delete
+    AFTER DELETE ON public.locations
+    REFERENCING OLD TABLE AS oldrows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE public.locationrevisions_bump();
@@ -0,0 +1,4 @@
+-- Two devices at the same place in the same second aren't duplicates. unique_device_timestamps already stops a device
+-- storing the same fix twice
+ALTER TABLE public.locations
+    DROP CONSTRAINT locations_unique_point_devicetimestamp;
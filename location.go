@@ -1,17 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dustin/go-humanize"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
 	"github.com/martinlindhe/unit"
 	"log"
-	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -19,6 +16,7 @@ import (
 This should be some sort of thing that's sent from the phone
 */
 type Location struct {
+	ID                   int64   `json:"-"`
 	Latitude             float64 `json:"lat" binding:"required"`
 	Longitude            float64 `json:"long" binding:"required"`
 	Timestamp            time.Time
@@ -31,6 +29,58 @@ type Location struct {
 	VerticalAccuracy     float32
 	Speed                float32
 	Geocoding            string
+	User                 string
+	Device               string
+	TrackerId            string
+	Battery              int
+	BatteryStatus        int
+	Connection           string
+	Trigger              string
+	SSID                 string
+	BSSID                string
+	InRegions            []string
+	CourseOverGround     int
+	Pressure             float64
+	MonitoringMode       int
+	Topic                string
+	Doze                 bool `json:"-"`
+}
+
+/*
+The columns after the position that both the last and locations queries return
+*/
+const locationDetailColumns = "username, " +
+	"device, " +
+	"coalesce(trackerid, ''), " +
+	"coalesce(batterylevel, 0), " +
+	"coalesce(batterystatus, 0), " +
+	"coalesce(connectiontype, ''), " +
+	"coalesce(trigger, ''), " +
+	"coalesce(ssid, ''), " +
+	"coalesce(bssid, ''), " +
+	"inregions, " +
+	"coalesce(courseoverground, 0), " +
+	"coalesce(pressure, 0), " +
+	"coalesce(monitoringmode, 0), " +
+	"coalesce(topic, '') "
+
+func (location *Location) detailScanTargets() []interface{} {
+	return []interface{}{
+		&location.User,
+		&location.Device,
+		&location.TrackerId,
+		&location.Battery,
+		&location.BatteryStatus,
+		&location.Connection,
+		&location.Trigger,
+		&location.SSID,
+		&location.BSSID,
+		pq.Array(&location.InRegions),
+		&location.CourseOverGround,
+		&location.Pressure,
+		&location.MonitoringMode,
+		&location.Topic,
+	}
 }
 
 func GetLastLocation() (*Location, error) {
@@ -44,13 +94,108 @@ func GetLastLocation() (*Location, error) {
 		"ST_Y(ST_AsText(point)), " +
 		"ST_X(ST_AsText(point)) " +
 		"from locations " +
-		"where geocoding is not null " +
+		"where geocoding is not null and not excluded " +
 		"order by devicetimestamp desc " +
 		"limit 1"
 	err := db.QueryRow(query).Scan(&location.Geocoding, &location.Latitude, &location.Longitude)
 	return &location, err
 }
 
+/*
+The recorder's list API goes users, then a user's devices, then a device's monthly .rec files. We don't keep .rec
+files, so those are made up from the months that have data
+*/
+func recorderListQuery(user string, device string) (string, []interface{}) {
+	switch {
+	case user == "":
+		return "select distinct username from locations order by username", nil
+	case device == "":
+		return "select distinct device from locations where username=$1 order by device", []interface{}{user}
+	default:
+		return "select distinct to_char(devicetimestamp at time zone 'UTC', 'YYYY-MM') || '.rec' as month from locations " +
+			"where username=$1 and device=$2 order by month", []interface{}{user, device}
+	}
+}
+
+func GetRecorderList(user string, device string) ([]string, error) {
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	query, args := recorderListQuery(user, device)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []string{}
+	for rows.Next() {
+		var result string
+		err := rows.Scan(&result)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+/*
+Matches everyone when the user or device argument is blank. Takes the placeholder number of the user, with the device
+straight after it
+*/
+func userDeviceFilter(userArg int) string {
+	return fmt.Sprintf("($%d = '' or username = $%d) and ($%d = '' or device = $%d) ", userArg, userArg, userArg+1, userArg+1)
+}
+
+/*
+Each device's newest included fix, for everyone or just the user and device asked for
+*/
+var lastLocationsQuery = "select distinct on (username, device) " +
+	"coalesce(geocoding ->> 'formatted_address', geocoding -> 'results' -> 0 ->> 'formatted_address', ''), " +
+	"ST_Y(ST_AsText(point)), " +
+	"ST_X(ST_AsText(point)), " +
+	"devicetimestamp, " +
+	"coalesce(speed, 0), " +
+	"coalesce(altitude, 0), " +
+	"accuracy, " +
+	"coalesce(verticalaccuracy, 0), " +
+	locationDetailColumns +
+	"from locations where not excluded " +
+	"and " + userDeviceFilter(1) +
+	"order by username, device, devicetimestamp desc"
+
+func GetLastLocations(user string, device string) (*[]Location, error) {
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	rows, err := db.Query(lastLocationsQuery, user, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var locations []Location
+	for rows.Next() {
+		var location Location
+		err := rows.Scan(append([]interface{}{
+			&location.Geocoding,
+			&location.Latitude,
+			&location.Longitude,
+			&location.DeviceTimestamp,
+			&location.Speed,
+			&location.Altitude,
+			&location.Accuracy,
+			&location.VerticalAccuracy,
+		}, location.detailScanTargets()...)...)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return &locations, rows.Err()
+}
+
 func GetTotalDistanceInMiles() (float64, error) {
 	if db == nil {
 		return 0, errors.New("No database connection available")
@@ -65,32 +210,79 @@ func GetTotalDistanceInMiles() (float64, error) {
 	return distanceInMeters.Miles(), nil
 }
 
-func GetLocationsBetweenDates(from time.Time, to time.Time) (*[]Location, error) {
-	if db == nil {
-		return nil, errors.New("No database connection available")
+/*
+Calls each for every location in the range without holding them all in memory. order is the SQL order by clause
+*/
+func StreamLocationsBetweenDates(from time.Time, to time.Time, user string, device string, order string, each func(*Location) error) error {
+	return streamLocations(locationsBetweenDatesQuery(windowedSpeed, "")+"order by "+order, []interface{}{from, to, user, device}, each)
+}
+
+/*
+A page of the range, newest first, starting after the cursor if there is one. limit of 0 means the rest of the range
+*/
+func StreamLocationsPage(from time.Time, to time.Time, user string, device string, after *LocationCursor, limit int, each func(*Location) error) error {
+	// Each row looks up its own previous fix, so the cursor and limit can go straight on the query and a page only
+	// reads its own rows
+	query := locationsBetweenDatesQuery(lookbackSpeed, previousFixJoin)
+	args := []interface{}{from, to, user, device}
+	if after != nil {
+		query += "and (devicetimestamp, id) < ($5, $6) "
+		args = append(args, after.DeviceTimestamp, after.ID)
 	}
-	defer timeTrack(time.Now())
-	query := "select " +
-		"coalesce(geocoding -> 'results' -> 0 ->> 'formatted_address', ''), " +
+	query += "order by devicetimestamp desc, id desc"
+	if limit > 0 {
+		query += fmt.Sprintf(" limit %d", limit)
+	}
+	return streamLocations(query, args, each)
+}
+
+/*
+Speed where the device didn't report one, from the fix before in the range. Windowing is cheapest when reading the
+whole range
+*/
+const windowedSpeed = "coalesce(speed, coalesce(3.6*ST_Distance(point,lag(point,1,point) over (partition by username, device order by devicetimestamp asc))/extract('epoch' from (devicetimestamp-lag(devicetimestamp) over (partition by username, device order by devicetimestamp asc))),0)) as speed, "
+
+/*
+The same speed, from a one row lookback to the fix before, for when only part of the range is read
+*/
+const lookbackSpeed = "coalesce(speed, coalesce(3.6*ST_Distance(point,previouspoint)/extract('epoch' from (devicetimestamp-previoustimestamp)),0)) as speed, "
+
+const previousFixJoin = "left join lateral (select point as previouspoint, devicetimestamp as previoustimestamp " +
+	"from locations as previous where previous.username = locations.username and previous.device = locations.device " +
+	"and not previous.excluded and previous.devicetimestamp >= $1 and previous.devicetimestamp < locations.devicetimestamp " +
+	"order by previous.devicetimestamp desc limit 1) as lookback on true "
+
+func locationsBetweenDatesQuery(speed string, join string) string {
+	return "select " +
+		"id, " +
+		"coalesce(geocoding ->> 'formatted_address', geocoding -> 'results' -> 0 ->> 'formatted_address', ''), " +
 		"ST_Y(ST_AsText(point)), " +
 		"ST_X(ST_AsText(point)), " +
 		"devicetimestamp, " +
-		"coalesce(speed, coalesce(3.6*ST_Distance(point,lag(point,1,point) over (order by devicetimestamp asc))/extract('epoch' from (devicetimestamp-lag(devicetimestamp) over (order by devicetimestamp asc))),0)) as speed, " +
+		speed +
 		"coalesce(altitude, 0), " +
 		"accuracy, " +
-		"coalesce(verticalaccuracy, 0) " +
-		"from locations where " +
-		"devicetimestamp>=$1 and devicetimestamp<$2 " +
-		"order by devicetimestamp desc"
-	rows, err := db.Query(query, from, to)
+		"coalesce(verticalaccuracy, 0), " +
+		locationDetailColumns +
+		"from locations " + join + "where not excluded " +
+		"and devicetimestamp>=$1 and devicetimestamp<$2 " +
+		"and " + userDeviceFilter(3)
+}
+
+func streamLocations(query string, args []interface{}, each func(*Location) error) error {
+	if db == nil {
+		return errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
-	var locations []Location
 	for rows.Next() {
 		var location Location
-		err := rows.Scan(
+		err := rows.Scan(append([]interface{}{
+			&location.ID,
 			&location.Geocoding,
 			&location.Latitude,
 			&location.Longitude,
@@ -99,14 +291,16 @@ func GetLocationsBetweenDates(from time.Time, to time.Time) (*[]Location, error)
 			&location.Altitude,
 			&location.Accuracy,
 			&location.VerticalAccuracy,
-		)
+		}, location.detailScanTargets()...)...)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		err = each(&location)
+		if err != nil {
+			return err
 		}
-		locations = append(locations, location)
 	}
-	return &locations, nil
-
+	return rows.Err()
 }
 
 /* HTTP handlers */
@@ -137,51 +331,103 @@ func LocationHeadHandler(c *gin.Context) {
 }
 
 func OTListUserHandler(c *gin.Context) {
+	user := c.Query("user")
+	device := c.Query("device")
+	results, err := GetRecorderList(user, device)
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
 	c.JSON(200, gin.H{
-		"results": []string{"growse"},
+		"results": results,
 	})
 }
 
 type OTPos struct {
-	Tst  int64   `json:"tst" binding:"required"`
-	Acc  float32 `json:"acc" binding:"required"`
-	Type string  `json:"_type" binding:"required"`
-	Alt  float32 `json:"alt" binding:"required"`
-	Lon  float64 `json:"lon" binding:"required"`
-	Vac  float32 `json:"vac" binding:"required"`
-	Vel  float32 `json:"vel" binding:"required"`
-	Lat  float64 `json:"lat" binding:"required"`
-	Addr string  `json:"addr" binding:"required"`
+	Tst       int64    `json:"tst" binding:"required"`
+	Acc       float32  `json:"acc" binding:"required"`
+	Type      string   `json:"_type" binding:"required"`
+	Alt       float32  `json:"alt" binding:"required"`
+	Lon       float64  `json:"lon" binding:"required"`
+	Vac       float32  `json:"vac" binding:"required"`
+	Vel       float32  `json:"vel" binding:"required"`
+	Lat       float64  `json:"lat" binding:"required"`
+	Addr      string   `json:"addr" binding:"required"`
+	User      string   `json:"username"`
+	Dev       string   `json:"device"`
+	Tid       string   `json:"tid"`
+	Name      string   `json:"name,omitempty"`
+	Face      string   `json:"face,omitempty"`
+	Topic     string   `json:"topic,omitempty"`
+	Batt      int      `json:"batt,omitempty"`
+	Bs        int      `json:"bs,omitempty"`
+	Conn      string   `json:"conn,omitempty"`
+	T         string   `json:"t,omitempty"`
+	SSID      string   `json:"SSID,omitempty"`
+	BSSID     string   `json:"BSSID,omitempty"`
+	InRegions []string `json:"inregions,omitempty"`
+	Cog       int      `json:"cog,omitempty"`
+	P         float64  `json:"p,omitempty"`
+	M         int      `json:"m,omitempty"`
 }
 
 func (location Location) toOT() OTPos {
 	return OTPos{
-		Tst:  location.DeviceTimestamp.Unix(),
-		Acc:  location.Accuracy,
-		Type: "location",
-		Alt:  location.Altitude,
-		Lat:  location.Latitude,
-		Lon:  location.Longitude,
-		Vel:  location.Speed,
-		Vac:  location.VerticalAccuracy,
-		Addr: location.Geocoding,
+		Tst:       location.DeviceTimestamp.Unix(),
+		Acc:       location.Accuracy,
+		Type:      "location",
+		Alt:       location.Altitude,
+		Lat:       location.Latitude,
+		Lon:       location.Longitude,
+		Vel:       location.Speed,
+		Vac:       location.VerticalAccuracy,
+		Addr:      location.Geocoding,
+		User:      location.User,
+		Dev:       location.Device,
+		Tid:       location.TrackerId,
+		Topic:     location.Topic,
+		Batt:      location.Battery,
+		Bs:        location.BatteryStatus,
+		Conn:      location.Connection,
+		T:         location.Trigger,
+		SSID:      location.SSID,
+		BSSID:     location.BSSID,
+		InRegions: location.InRegions,
+		Cog:       location.CourseOverGround,
+		P:         location.Pressure,
+		M:         location.MonitoringMode,
 	}
 }
 
 func OTLastPosHandler(c *gin.Context) {
-	location, err := GetLastLocation()
+	locations, err := GetLastLocations(c.Query("user"), c.Query("device"))
 	if err != nil {
 		c.String(500, err.Error())
 		return
 	}
-	if location == nil {
+	if locations == nil || len(*locations) == 0 {
 		c.String(500, "No location found")
 		return
 	}
-	last := location.toOT()
-	c.JSON(200, []OTPos{
-		last,
-	})
+	cards, err := GetCards(c.Query("user"), c.Query("device"))
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	cardsByDevice := make(map[string]MQTTCard)
+	for _, card := range cards {
+		cardsByDevice[card.User+"/"+card.Device] = card
+	}
+	var last []OTPos
+	for _, location := range *locations {
+		position := location.toOT()
+		if card, ok := cardsByDevice[location.User+"/"+location.Device]; ok {
+			position.Name = card.Name
+			position.Face = card.Face
+		}
+		last = append(last, position)
+	}
+	c.JSON(200, last)
 }
 
 func OTLocationsHandler(c *gin.Context) {
@@ -200,170 +446,177 @@ func OTLocationsHandler(c *gin.Context) {
 		return
 	}
 
-	locations, err := GetLocationsBetweenDates(fromTime, toTime)
+	limit := 0
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 {
+			c.String(400, fmt.Sprintf("Invalid limit %v", c.Query("limit")))
+			return
+		}
+	}
+	var after *LocationCursor
+	if c.Query("after") != "" {
+		after, err = parseLocationCursor(c.Query("after"))
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+	}
+
+	simplify, err := parseSimplifyOptions(c.Query("tolerance"), c.Query("zoom"), c.Query("bucket"))
 	if err != nil {
-		c.String(500, err.Error())
+		c.String(400, err.Error())
 		return
 	}
-	if locations == nil {
-		c.String(500, "No locations found")
+	if simplify.enabled() && (limit > 0 || after != nil) {
+		c.String(400, "A simplified track can't be paged")
 		return
 	}
-	var otpos []OTPos
-	for _, location := range *locations {
-		otpos = append(otpos, location.toOT())
-	}
-	response := struct {
-		Data []OTPos `json:"data"`
-	}{otpos}
-	responseBytes, _ := json.Marshal(response)
-	responseReader := bytes.NewReader(responseBytes)
-	c.DataFromReader(200, int64(len(responseBytes)), "application/json", responseReader, nil)
-}
-
-func OTVersionHandler(c *gin.Context) {
-	c.JSON(200, gin.H{"version": "1.0-growse-locator"})
-}
 
-var wsupgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-func wshandler(w http.ResponseWriter, r *http.Request) {
-	// At the moment, this is just an echo impl. At some point publish new updates down this.
-	wsupgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	conn, err := wsupgrader.Upgrade(w, r, nil)
+	etag, err := LocationsETag(c.Query("user"), c.Query("device"), c.Request.URL.RawQuery)
 	if err != nil {
-		log.Printf("Failed to set websocket upgrade: %+v\n", err)
+		c.String(500, err.Error())
+		return
+	}
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(304)
 		return
 	}
 
-	for {
-		t, msg, err := conn.ReadMessage()
-		if err != nil {
-			break
-		}
-		switch string(msg) {
-		case "LAST":
-			location, err := GetLastLocation()
-			if err != nil {
-				log.Printf("Error fetching last location: %v", err)
-				break
-			}
-			locationAsBytes, err := json.Marshal(location.toOT())
+	if simplify.enabled() {
+		err = writeOTLocations(c, 0, func(each func(*Location) error) error {
+			add, finish := simplifyStream(simplify, each)
+			err := StreamLocationsBetweenDates(fromTime, toTime, c.Query("user"), c.Query("device"), "username, device, devicetimestamp desc", add)
 			if err != nil {
-				log.Printf("Error formatting location for websocket: %v", err)
-				break
+				return err
 			}
-			conn.WriteMessage(t, locationAsBytes)
-			break
-		default:
-			break
+			return finish()
+		})
+		if err != nil {
+			InternalError(err)
 		}
-	}
-}
-
-func PlaceHandler(c *gin.Context) {
-	if db == nil {
-		c.String(500, "No database connection available")
-		c.Abort()
 		return
 	}
-	place := c.PostForm("place")
-	geocoding, err := GetGeocoding(place)
+	err = writeOTLocations(c, limit, func(each func(*Location) error) error {
+		// One more than the page so we know whether there's another
+		pageSize := 0
+		if limit > 0 {
+			pageSize = limit + 1
+		}
+		return StreamLocationsPage(fromTime, toTime, c.Query("user"), c.Query("device"), after, pageSize, each)
+	})
 	if err != nil {
 		InternalError(err)
-		c.String(500, err.Error())
-		c.Abort()
-		return
 	}
+}
 
-	if len(geocoding.Features) == 0 {
-		c.HTML(200, "placeResults", gin.H{"results": nil, "place": place})
-		c.Abort()
+/*
+Streams the locations out as {"data": [OTPos...]}, with a next cursor if there are more than limit of them
+*/
+func writeOTLocations(c *gin.Context, limit int, stream func(each func(*Location) error) error) error {
+	output := newJSONDataStream(c)
+	count := 0
+	var last, next *LocationCursor
+	err := stream(func(location *Location) error {
+		if limit > 0 && count == limit {
+			next = last
+			return nil
+		}
+		count++
+		last = &LocationCursor{DeviceTimestamp: location.DeviceTimestamp, ID: location.ID}
+		return output.Write(location.toOT())
+	})
+	if err != nil {
+		if !output.started {
+			c.String(500, err.Error())
+		}
+		output.Abort()
+		return err
+	}
+	fields := gin.H{}
+	if next != nil {
+		fields["next"] = next.String()
+	}
+	return output.Close(fields)
+}
+
+func OTVersionHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"version": "1.0-growse-locator"})
+}
+
+/*
+OwnTracks HTTP mode. Takes the same payloads as MQTT, and replies with the last location and card of the device's
+friends
+*/
+func OTPubHandler(c *gin.Context) {
+	user := c.GetString("owntracksUser")
+	device := c.GetString("owntracksDevice")
+	payload, err := c.GetRawData()
+	if err != nil {
+		c.String(400, err.Error())
 		return
 	}
-	feature := geocoding.Features[0]
-	var rows *sql.Rows
-	if feature.Properties["bounds"] != nil {
-		bounds := feature.Properties["bounds"].(map[string]interface{})
-		rows, err = db.Query(`
-select 
-count(*) as c,
-date(devicetimestamp) 
-from locations 
-where point && ST_SetSRID(ST_MakeBox2D(ST_Point($1,$2),	ST_Point($3,$4)),4326)
-group by date(devicetimestamp) order by c desc limit 20
-`,
-			bounds["northeast"].(map[string]interface{})["lng"],
-			bounds["northeast"].(map[string]interface{})["lat"],
-			bounds["southwest"].(map[string]interface{})["lng"],
-			bounds["southwest"].(map[string]interface{})["lat"])
-	} else if feature.Geometry.IsPoint() && feature.Properties["confidence"] != nil && feature.Properties["confidence"].(float64) >= 1 && feature.Properties["confidence"].(float64) <= 10 {
-		var radius int
-		switch confidence := feature.Properties["confidence"].(float64); confidence {
-		case 10:
-			radius = 250
-		case 9:
-			radius = 500
-		case 8:
-			radius = 1000
-		case 7:
-			radius = 5000
-		case 6:
-			radius = 7500
-		case 5:
-			radius = 10000
-		case 4:
-			radius = 15000
-		case 3:
-			radius = 20000
-		case 2:
-			fallthrough
-		case 1:
-			fallthrough
-		default:
-			radius = 25000
+	err = handleOwntracksMessage(user, device, payload)
+	if err != nil {
+		log.Printf("Error handling OwnTracks HTTP message from %v/%v: %v", user, device, err)
+		if errors.Is(err, errLocationNotStored) {
+			// The app keeps the location and tries again on anything but success
+			c.String(503, err.Error())
+			return
 		}
-		rows, err = db.Query(`
-select 
-count(*) as c,
-date(devicetimestamp) 
-from locations 
-where ST_DWithin(point,ST_SetSRID(ST_Point( $1, $2),4326),$3)
-group by date(devicetimestamp) order by c desc limit 20
-`, feature.Geometry.Point[0], feature.Geometry.Point[1], radius)
-	} else {
-		c.String(500, "No valid geometries found in geocoding response", geocoding)
-		c.Abort()
+		c.String(400, err.Error())
 		return
 	}
+	friends, err := getFriendsForDevice(user, device)
 	if err != nil {
 		InternalError(err)
-		c.String(500, err.Error())
-		c.Abort()
+		c.JSON(200, []interface{}{})
 		return
 	}
-	defer rows.Close()
-	var results []LocationCountPerDay
-	for rows.Next() {
-		var result LocationCountPerDay
-		err := rows.Scan(&result.LocationCount, &result.Date)
-		if err != nil {
-			InternalError(err)
-			c.String(500, "Error fetching values from database: %v", err)
-			c.Abort()
-			return
+	c.JSON(200, friends)
+}
+
+/*
+The users whose devices a device gets to see: its own, plus any friends configured for it
+*/
+func friendUsers(devices []OwntracksHTTPDevice, user string, device string) map[string]bool {
+	users := map[string]bool{user: true}
+	for _, credential := range devices {
+		if credential.User == user && credential.Device == device {
+			for _, friend := range credential.Friends {
+				users[friend] = true
+			}
 		}
-		results = append(results, result)
 	}
-	c.HTML(200, "placeResults", gin.H{"results": results, "place": place, "formatted": feature.Properties["formatted"]})
+	return users
 }
 
-type (
-	LocationCountPerDay struct {
-		LocationCount int
-		Date          time.Time
+func getFriendsForDevice(user string, device string) ([]interface{}, error) {
+	users := friendUsers(configuration.OwntracksHTTPDevices, user, device)
+	friends := []interface{}{}
+	cards, err := GetCards("", "")
+	if err != nil {
+		return nil, err
 	}
-)
+	for _, card := range cards {
+		if !users[card.User] || (card.User == user && card.Device == device) {
+			continue
+		}
+		card.Topic = fmt.Sprintf("owntracks/%s/%s", card.User, card.Device)
+		friends = append(friends, card)
+	}
+	locations, err := GetLastLocations("", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, location := range *locations {
+		if !users[location.User] || (location.User == user && location.Device == device) {
+			continue
+		}
+		position := location.toOT()
+		position.Topic = fmt.Sprintf("owntracks/%s/%s", location.User, location.Device)
+		friends = append(friends, position)
+	}
+	return friends, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+/*
+The non-location things that OwnTracks publishes. User and Device always come from the topic (or headers), never the payload
+*/
+type MQTTTransition struct {
+	Type                   string  `json:"_type" binding:"required"`
+	TrackerId              string  `json:"tid"`
+	Accuracy               float32 `json:"acc"`
+	Description            string  `json:"desc"`
+	Event                  string  `json:"event"`
+	Latitude               float64 `json:"lat"`
+	Longitude              float64 `json:"lon"`
+	Trigger                string  `json:"t"`
+	RegionId               string  `json:"rid,omitempty"`
+	DeviceTimestampAsInt   int64   `json:"tst" binding:"required"`
+	WaypointTimestampAsInt int64   `json:"wtst"`
+	User                   string  `json:"username"`
+	Device                 string  `json:"device"`
+}
+
+type MQTTWaypoint struct {
+	Type                 string  `json:"_type"`
+	Description          string  `json:"desc"`
+	Latitude             float64 `json:"lat"`
+	Longitude            float64 `json:"lon"`
+	Radius               int     `json:"rad"`
+	RegionId             string  `json:"rid,omitempty"`
+	DeviceTimestampAsInt int64   `json:"tst" binding:"required"`
+	User                 string  `json:"username"`
+	Device               string  `json:"device"`
+}
+
+type MQTTWaypoints struct {
+	Type      string         `json:"_type"`
+	Waypoints []MQTTWaypoint `json:"waypoints"`
+}
+
+type MQTTLWT struct {
+	Type                 string `json:"_type"`
+	DeviceTimestampAsInt int64  `json:"tst"`
+}
+
+type MQTTCard struct {
+	Type      string `json:"_type"`
+	Name      string `json:"name"`
+	Face      string `json:"face,omitempty"`
+	TrackerId string `json:"tid,omitempty"`
+	User      string `json:"username"`
+	Device    string `json:"device"`
+	Topic     string `json:"topic,omitempty"`
+}
+
+func insertTransitionToDatabase(transition MQTTTransition) error {
+	if db == nil {
+		return errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	var waypointTimestamp *time.Time
+	if transition.WaypointTimestampAsInt != 0 {
+		wtst := time.Unix(transition.WaypointTimestampAsInt, 0)
+		waypointTimestamp = &wtst
+	}
+	_, err := db.Exec(
+		"insert into transitions "+
+			"(timestamp, devicetimestamp, waypointtimestamp, username, device, trackerid, event, description, regionid, trigger, accuracy, point) "+
+			"values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, ST_SetSRID(ST_MakePoint($12, $13), 4326)) "+
+			"on conflict on constraint unique_transitions do nothing",
+		time.Now(),
+		time.Unix(transition.DeviceTimestampAsInt, 0),
+		waypointTimestamp,
+		transition.User,
+		transition.Device,
+		transition.TrackerId,
+		transition.Event,
+		transition.Description,
+		transition.RegionId,
+		transition.Trigger,
+		transition.Accuracy,
+		transition.Longitude,
+		transition.Latitude,
+	)
+	return err
+}
+
+func insertWaypointsToDatabase(user string, device string, waypoints []MQTTWaypoint) error {
+	if db == nil {
+		return errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, waypoint := range waypoints {
+		_, err = tx.Exec(
+			"insert into waypoints "+
+				"(timestamp, waypointtimestamp, username, device, description, regionid, radius, point) "+
+				"values ($1, $2, $3, $4, $5, $6, $7, ST_SetSRID(ST_MakePoint($8, $9), 4326)) "+
+				"on conflict (username, device, waypointtimestamp) do update set "+
+				"timestamp = excluded.timestamp, description = excluded.description, regionid = excluded.regionid, radius = excluded.radius, point = excluded.point",
+			time.Now(),
+			time.Unix(waypoint.DeviceTimestampAsInt, 0),
+			user,
+			device,
+			waypoint.Description,
+			waypoint.RegionId,
+			waypoint.Radius,
+			waypoint.Longitude,
+			waypoint.Latitude,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func insertLWTToDatabase(user string, device string, lwt MQTTLWT) error {
+	if db == nil {
+		return errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	_, err := db.Exec(
+		"insert into lwts (timestamp, devicetimestamp, username, device) values ($1, $2, $3, $4)",
+		time.Now(),
+		time.Unix(lwt.DeviceTimestampAsInt, 0),
+		user,
+		device,
+	)
+	return err
+}
+
+func insertCardToDatabase(card MQTTCard) error {
+	if db == nil {
+		return errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	_, err := db.Exec(
+		"insert into cards (timestamp, username, device, trackerid, name, face) values ($1, $2, $3, $4, $5, $6) "+
+			"on conflict (username, device) do update set "+
+			"timestamp = excluded.timestamp, trackerid = excluded.trackerid, name = excluded.name, face = excluded.face",
+		time.Now(),
+		card.User,
+		card.Device,
+		card.TrackerId,
+		card.Name,
+		card.Face,
+	)
+	return err
+}
+
+func GetTransitionsBetweenDates(from time.Time, to time.Time, user string, device string) ([]MQTTTransition, error) {
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	rows, err := db.Query(
+		"select "+
+			"devicetimestamp, "+
+			"coalesce(waypointtimestamp, devicetimestamp), "+
+			"username, "+
+			"device, "+
+			"coalesce(trackerid, ''), "+
+			"event, "+
+			"coalesce(description, ''), "+
+			"coalesce(regionid, ''), "+
+			"coalesce(trigger, ''), "+
+			"coalesce(accuracy, 0), "+
+			"ST_Y(ST_AsText(point)), "+
+			"ST_X(ST_AsText(point)) "+
+			"from transitions where "+
+			"devicetimestamp>=$1 and devicetimestamp<$2 "+
+			"and ($3 = '' or username = $3) and ($4 = '' or device = $4) "+
+			"order by devicetimestamp desc",
+		from, to, user, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	transitions := []MQTTTransition{}
+	for rows.Next() {
+		var transition MQTTTransition
+		var deviceTimestamp, waypointTimestamp time.Time
+		err := rows.Scan(
+			&deviceTimestamp,
+			&waypointTimestamp,
+			&transition.User,
+			&transition.Device,
+			&transition.TrackerId,
+			&transition.Event,
+			&transition.Description,
+			&transition.RegionId,
+			&transition.Trigger,
+			&transition.Accuracy,
+			&transition.Latitude,
+			&transition.Longitude,
+		)
+		if err != nil {
+			return nil, err
+		}
+		transition.Type = "transition"
+		transition.DeviceTimestampAsInt = deviceTimestamp.Unix()
+		transition.WaypointTimestampAsInt = waypointTimestamp.Unix()
+		transitions = append(transitions, transition)
+	}
+	return transitions, rows.Err()
+}
+
+func GetWaypoints(user string, device string) ([]MQTTWaypoint, error) {
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	rows, err := db.Query(
+		"select "+
+			"waypointtimestamp, "+
+			"username, "+
+			"device, "+
+			"description, "+
+			"coalesce(regionid, ''), "+
+			"coalesce(radius, 0), "+
+			"ST_Y(ST_AsText(point)), "+
+			"ST_X(ST_AsText(point)) "+
+			"from waypoints where "+
+			"($1 = '' or username = $1) and ($2 = '' or device = $2) "+
+			"order by username, device, description",
+		user, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	waypoints := []MQTTWaypoint{}
+	for rows.Next() {
+		var waypoint MQTTWaypoint
+		var waypointTimestamp time.Time
+		err := rows.Scan(
+			&waypointTimestamp,
+			&waypoint.User,
+			&waypoint.Device,
+			&waypoint.Description,
+			&waypoint.RegionId,
+			&waypoint.Radius,
+			&waypoint.Latitude,
+			&waypoint.Longitude,
+		)
+		if err != nil {
+			return nil, err
+		}
+		waypoint.Type = "waypoint"
+		waypoint.DeviceTimestampAsInt = waypointTimestamp.Unix()
+		waypoints = append(waypoints, waypoint)
+	}
+	return waypoints, rows.Err()
+}
+
+func GetCards(user string, device string) ([]MQTTCard, error) {
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	rows, err := db.Query(
+		"select username, device, coalesce(trackerid, ''), coalesce(name, ''), coalesce(face, '') "+
+			"from cards where "+
+			"($1 = '' or username = $1) and ($2 = '' or device = $2) "+
+			"order by username, device",
+		user, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cards := []MQTTCard{}
+	for rows.Next() {
+		var card MQTTCard
+		err := rows.Scan(&card.User, &card.Device, &card.TrackerId, &card.Name, &card.Face)
+		if err != nil {
+			return nil, err
+		}
+		card.Type = "card"
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+/* HTTP handlers */
+func OTTransitionsHandler(c *gin.Context) {
+	const iso8061fmt = "2006-01-02T15:04:05"
+	from := c.DefaultQuery("from", time.Now().AddDate(0, 0, -1).Format(iso8061fmt))
+	to := c.DefaultQuery("to", time.Now().Format(iso8061fmt))
+	fromTime, err := time.Parse(iso8061fmt, from)
+	if err != nil {
+		c.String(500, fmt.Sprintf("Invalid from time %v: %v", from, err))
+		return
+	}
+	toTime, err := time.Parse(iso8061fmt, to)
+	if err != nil {
+		c.String(500, fmt.Sprintf("Invalid to time %v: %v", to, err))
+		return
+	}
+	transitions, err := GetTransitionsBetweenDates(fromTime, toTime, c.Query("user"), c.Query("device"))
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"data": transitions})
+}
+
+func OTWaypointsHandler(c *gin.Context) {
+	waypoints, err := GetWaypoints(c.Query("user"), c.Query("device"))
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"data": waypoints})
+}
+
+func OTCardsHandler(c *gin.Context) {
+	cards, err := GetCards(c.Query("user"), c.Query("device"))
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"data": cards})
+}
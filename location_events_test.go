@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTransitionUnmarshalWorks(t *testing.T) {
+	testMsg := "{\"_type\":\"transition\",\"tid\":\"s5\",\"acc\":12,\"desc\":\"Home\",\"event\":\"leave\",\"lat\":51.7471862,\"lon\":-0.4734345,\"t\":\"c\",\"tst\":1483358150,\"wtst\":1483300000}"
+
+	var transition MQTTTransition
+	err := json.Unmarshal([]byte(testMsg), &transition)
+	assert.Nil(t, err)
+	assert.Equal(t, "leave", transition.Event)
+	assert.Equal(t, "Home", transition.Description)
+	assert.Equal(t, int64(1483300000), transition.WaypointTimestampAsInt)
+	assert.Equal(t, "c", transition.Trigger)
+}
+
+func TestWaypointsUnmarshalWorks(t *testing.T) {
+	testMsg := "{\"_type\":\"waypoints\",\"waypoints\":[{\"_type\":\"waypoint\",\"desc\":\"Home\",\"lat\":51.74,\"lon\":-0.47,\"rad\":50,\"tst\":1483300000},{\"_type\":\"waypoint\",\"desc\":\"Work\",\"lat\":51.5,\"lon\":-0.12,\"rad\":100,\"tst\":1483300001}]}"
+
+	var waypoints MQTTWaypoints
+	err := json.Unmarshal([]byte(testMsg), &waypoints)
+	assert.Nil(t, err)
+	assert.Len(t, waypoints.Waypoints, 2)
+	assert.Equal(t, "Work", waypoints.Waypoints[1].Description)
+	assert.Equal(t, 100, waypoints.Waypoints[1].Radius)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	exclusionAccuracy = "accuracy"
+	exclusionSpeed    = "speed"
+)
+
+/*
+Fixes worse than MaxAccuracy metres, or implying we moved faster than MaxSpeed km/h, are excluded. Zero turns a test off
+*/
+type ExclusionOptions struct {
+	MaxAccuracy float64
+	MaxSpeed    float64
+}
+
+func defaultExclusionOptions() ExclusionOptions {
+	return ExclusionOptions{
+		MaxAccuracy: configuration.MaxLocationAccuracy,
+		MaxSpeed:    configuration.MaxImpliedSpeed,
+	}
+}
+
+/*
+Whether a fix is too inaccurate to keep. Doesn't need its neighbours, so it can be decided before the fix is stored
+*/
+func accuracyExcluded(accuracy float32, options ExclusionOptions) bool {
+	return options.MaxAccuracy > 0 && float64(accuracy) > options.MaxAccuracy
+}
+
+func impliedSpeed(from *Location, to *Location) float64 {
+	elapsed := to.DeviceTimestamp.Sub(from.DeviceTimestamp)
+	if elapsed <= 0 {
+		return 0
+	}
+	return 3.6 * haversineDistance(from.Latitude, from.Longitude, to.Latitude, to.Longitude) / elapsed.Seconds()
+}
+
+/*
+The speed test, run over one device's fixes in time order. A fix is an outlier when getting to it from the fix before
+was too fast, and getting from it to the fix after was too, so the genuine fix after a spike doesn't get the blame for
+the way back. Legs across a gap aren't judged, after a gap we can't tell a jump from a journey. The newest fix has no
+leg out so it's judged on the way in alone, until the next fix arrives and it's judged again
+*/
+type speedOutlierFilter struct {
+	maxSpeed float64
+	outlier  func(*Location)
+	previous *Location
+	current  *Location
+}
+
+func (filter *speedOutlierFilter) legTooFast(from *Location, to *Location) bool {
+	return to.DeviceTimestamp.Sub(from.DeviceTimestamp) <= trackGap && impliedSpeed(from, to) > filter.maxSpeed
+}
+
+func (filter *speedOutlierFilter) judge(next *Location) {
+	if filter.current == nil || filter.previous == nil {
+		return
+	}
+	if !filter.legTooFast(filter.previous, filter.current) {
+		return
+	}
+	if next != nil && next.DeviceTimestamp.Sub(filter.current.DeviceTimestamp) <= trackGap && !filter.legTooFast(filter.current, next) {
+		return
+	}
+	filter.outlier(filter.current)
+}
+
+func (filter *speedOutlierFilter) Add(location *Location) {
+	filter.judge(location)
+	filter.previous = filter.current
+	filter.current = location
+}
+
+/*
+Judges the last fix, and gets ready for another device
+*/
+func (filter *speedOutlierFilter) Finish() {
+	filter.judge(nil)
+	filter.previous = nil
+	filter.current = nil
+}
+
+/*
+Indexes of the speed outliers among one device's fixes
+*/
+func speedOutliers(points []Location, maxSpeed float64) []int {
+	var outliers []int
+	index := make(map[*Location]int)
+	filter := &speedOutlierFilter{maxSpeed: maxSpeed, outlier: func(location *Location) {
+		outliers = append(outliers, index[location])
+	}}
+	for i := range points {
+		index[&points[i]] = i
+		filter.Add(&points[i])
+	}
+	filter.Finish()
+	return outliers
+}
+
+/*
+The where clause limiting the exclusion backfill. Numbering of placeholders carries on from args
+*/
+func exclusionScope(user string, device string, from time.Time, to time.Time, args []interface{}) (string, []interface{}) {
+	conditions := []string{"true"}
+	if user != "" {
+		args = append(args, user)
+		conditions = append(conditions, fmt.Sprintf("username = $%d", len(args)))
+	}
+	if device != "" {
+		args = append(args, device)
+		conditions = append(conditions, fmt.Sprintf("device = $%d", len(args)))
+	}
+	if !from.IsZero() {
+		args = append(args, from)
+		conditions = append(conditions, fmt.Sprintf("devicetimestamp >= $%d", len(args)))
+	}
+	if !to.IsZero() {
+		args = append(args, to)
+		conditions = append(conditions, fmt.Sprintf("devicetimestamp < $%d", len(args)))
+	}
+	return strings.Join(conditions, " and "), args
+}
+
+type exclusionFix struct {
+	Location
+	reason string
+}
+
+/*
+What changed when the tests were run again
+*/
+type ExclusionResult struct {
+	Excluded []int64 `json:"-"`
+	Included int     `json:"included"`
+}
+
+/*
+Runs the tests over the stored fixes between from and to with the given options, so changing the limits applies to
+history too. Fixes up to trackGap either side are read as neighbours for the speed test but left alone. This is the
+only place the speed test is applied, new fixes get it by running this over the time around them. Only fixes whose
+verdict changed are written
+*/
+func ExcludeOutliers(options ExclusionOptions, user string, device string, from time.Time, to time.Time) (*ExclusionResult, error) {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	neighboursFrom := from
+	if !from.IsZero() {
+		neighboursFrom = from.Add(-trackGap)
+	}
+	neighboursTo := to
+	if !to.IsZero() {
+		neighboursTo = to.Add(trackGap)
+	}
+	scope, args := exclusionScope(user, device, neighboursFrom, neighboursTo, nil)
+	// Exclusions for other reasons aren't ours to undo, and those fixes aren't anyone's neighbours
+	rows, err := tx.Query("select id, username, device, devicetimestamp, ST_Y(point::geometry), ST_X(point::geometry), accuracy, "+
+		"coalesce(excludedreason, '') from locations where (not excluded or excludedreason in ('"+exclusionAccuracy+"', '"+exclusionSpeed+"')) and "+
+		scope+" order by username, device, devicetimestamp", args...)
+	if err != nil {
+		return nil, err
+	}
+	inScope := func(fix *exclusionFix) bool {
+		return (from.IsZero() || !fix.DeviceTimestamp.Before(from)) && (to.IsZero() || fix.DeviceTimestamp.Before(to))
+	}
+	wanted := make(map[string][]int64)
+	var cleared []int64
+	decide := func(fix *exclusionFix, reason string) {
+		if !inScope(fix) || fix.reason == reason {
+			return
+		}
+		if reason == "" {
+			cleared = append(cleared, fix.ID)
+		} else {
+			wanted[reason] = append(wanted[reason], fix.ID)
+		}
+	}
+	outliers := make(map[*Location]bool)
+	var pending []*exclusionFix
+	filter := &speedOutlierFilter{maxSpeed: options.MaxSpeed, outlier: func(location *Location) {
+		outliers[location] = true
+	}}
+	finishDevice := func() {
+		filter.Finish()
+		for _, fix := range pending {
+			if outliers[&fix.Location] {
+				decide(fix, exclusionSpeed)
+			} else {
+				decide(fix, "")
+			}
+		}
+		pending = nil
+		outliers = make(map[*Location]bool)
+	}
+	for rows.Next() {
+		fix := &exclusionFix{}
+		err = rows.Scan(&fix.ID, &fix.User, &fix.Device, &fix.DeviceTimestamp, &fix.Latitude, &fix.Longitude, &fix.Accuracy, &fix.reason)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(pending) > 0 && (pending[0].User != fix.User || pending[0].Device != fix.Device) {
+			finishDevice()
+		}
+		if accuracyExcluded(fix.Accuracy, options) {
+			decide(fix, exclusionAccuracy)
+			continue
+		}
+		if options.MaxSpeed > 0 {
+			filter.Add(&fix.Location)
+		}
+		pending = append(pending, fix)
+		// Only the last two can still be judged, so anything older is decided
+		for len(pending) > 2 {
+			if outliers[&pending[0].Location] {
+				decide(pending[0], exclusionSpeed)
+			} else {
+				decide(pending[0], "")
+			}
+			delete(outliers, &pending[0].Location)
+			pending = pending[1:]
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	finishDevice()
+
+	result := &ExclusionResult{Included: len(cleared)}
+	if len(cleared) > 0 {
+		_, err = tx.Exec("update locations set excluded=false, excludedreason=null where id = any($1)", pq.Array(cleared))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for reason, ids := range wanted {
+		_, err = tx.Exec("update locations set excluded=true, excludedreason=$1 where id = any($2)", reason, pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+		result.Excluded = append(result.Excluded, ids...)
+	}
+	return result, tx.Commit()
+}
+
+/*
+Speed tests a freshly inserted fix along with the fixes around it, which it may have changed the verdict on. True if
+the new fix itself is out
+*/
+func excludeAroundNewFix(id int64, user string, device string, timestamp time.Time) bool {
+	options := defaultExclusionOptions()
+	if options.MaxSpeed <= 0 {
+		return false
+	}
+	result, err := ExcludeOutliers(options, user, device, timestamp.Add(-trackGap), timestamp.Add(trackGap))
+	if err != nil {
+		log.Printf("Error running speed test around %v/%v at %v: %v", user, device, timestamp, err)
+		return false
+	}
+	for _, excluded := range result.Excluded {
+		if excluded == id {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Runs the exclusion tests over history with the configured limits. Takes the same from, to, user and device as the
+geocoding backfill, and detects visits again afterwards since they may have been built from fixes that are now gone
+*/
+func ExclusionBackfillHandler(c *gin.Context) {
+	from, err := parseBackfillDate(c.Query("from"))
+	if err != nil {
+		c.String(400, "Invalid from date: %v", err)
+		return
+	}
+	to, err := parseBackfillDate(c.Query("to"))
+	if err != nil {
+		c.String(400, "Invalid to date: %v", err)
+		return
+	}
+	user := c.Query("user")
+	device := c.Query("device")
+	options := defaultExclusionOptions()
+	result, err := ExcludeOutliers(options, user, device, from, to)
+	if err != nil {
+		InternalError(err)
+		c.String(500, err.Error())
+		return
+	}
+	devices, err := getAllDevices()
+	if err != nil {
+		InternalError(err)
+		c.String(500, err.Error())
+		return
+	}
+	for _, key := range devices {
+		if (user == "" || key.User == user) && (device == "" || key.Device == device) {
+			invalidateVisits(key.User, key.Device, from)
+		}
+	}
+	c.JSON(200, gin.H{"excluded": len(result.Excluded), "included": result.Included, "options": options})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAccuracyExcluded(t *testing.T) {
+	options := ExclusionOptions{MaxAccuracy: 100}
+	assert.False(t, accuracyExcluded(100, options))
+	assert.True(t, accuracyExcluded(1500, options))
+	assert.False(t, accuracyExcluded(1500, ExclusionOptions{}))
+}
+
+var exclusionTestStart = time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+
+/*
+A fix a minute for each latitude, so 0.01 degrees between fixes is about 67km/h
+*/
+func exclusionTrack(latitudes ...float64) []Location {
+	var points []Location
+	for i, latitude := range latitudes {
+		points = append(points, Location{Latitude: latitude, Longitude: -0.45, DeviceTimestamp: exclusionTestStart.Add(time.Duration(i) * time.Minute)})
+	}
+	return points
+}
+
+func TestSpeedOutliersBlameTheSpikeNotTheFixesAfterIt(t *testing.T) {
+	points := exclusionTrack(51.75, 51.76, 52.75, 51.77, 51.78, 51.79)
+	assert.Equal(t, []int{2}, speedOutliers(points, 300))
+}
+
+func TestSpeedOutliersDoNotCascadeAfterASpikeFollowingAGap(t *testing.T) {
+	points := exclusionTrack(51.75, 52.75, 52.76, 52.77, 52.78)
+	// The jump to 52.75 comes after a gap, so it could have been a flight and is believed
+	points[0].DeviceTimestamp = points[0].DeviceTimestamp.Add(-time.Hour)
+	assert.Empty(t, speedOutliers(points, 300))
+
+	// A spike straight after a gap can't be judged on the way in, and the genuine fixes after it are fine on the way
+	// out, so nothing after it is thrown away
+	points = exclusionTrack(51.75, 52.75, 51.76, 51.77, 51.78)
+	points[0].DeviceTimestamp = points[0].DeviceTimestamp.Add(-time.Hour)
+	assert.Empty(t, speedOutliers(points, 300))
+}
+
+func TestSpeedOutliersJudgeTheNewestFixOnTheWayIn(t *testing.T) {
+	assert.Equal(t, []int{2}, speedOutliers(exclusionTrack(51.75, 51.76, 52.75), 300))
+	// The first fix back from a spike looks like a jump until the fix after it shows the way out is fine
+	assert.Equal(t, []int{2, 3}, speedOutliers(exclusionTrack(51.75, 51.76, 52.75, 51.77), 300))
+	assert.Equal(t, []int{2}, speedOutliers(exclusionTrack(51.75, 51.76, 52.75, 51.77, 51.78), 300))
+}
+
+func TestExclusionScopeNumbersPlaceholdersAfterExistingArgs(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	scope, args := exclusionScope("growse", "", from, time.Time{}, []interface{}{exclusionAccuracy, 100.0})
+	assert.Equal(t, "true and username = $3 and devicetimestamp >= $4", scope)
+	assert.Equal(t, []interface{}{exclusionAccuracy, 100.0, "growse", from}, args)
+	scope, args = exclusionScope("", "", time.Time{}, time.Time{}, nil)
+	assert.Equal(t, "true", scope)
+	assert.Empty(t, args)
+}
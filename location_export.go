@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Writes a track out point by point, so an export never has to hold the whole range in memory. Points arrive grouped by
+device and in time order
+*/
+type trackWriter interface {
+	Begin() error
+	StartTrack(user string, device string) error
+	Point(location *Location) error
+	EndTrack() error
+	End() error
+}
+
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+	newWriter   func(io.Writer) trackWriter
+}{
+	"gpx":     {"application/gpx+xml", "gpx", func(w io.Writer) trackWriter { return &gpxWriter{w: w} }},
+	"kml":     {"application/vnd.google-earth.kml+xml", "kml", func(w io.Writer) trackWriter { return &kmlWriter{w: w} }},
+	"geojson": {"application/geo+json", "geojson", func(w io.Writer) trackWriter { return &geoJSONTrackWriter{w: w} }},
+}
+
+/*
+The format parameter wins, then the first format the Accept header asks for. GPX if neither says
+*/
+func exportFormat(format string, accept string) (string, error) {
+	if format != "" {
+		format = strings.ToLower(format)
+		if _, ok := exportFormats[format]; !ok {
+			return "", fmt.Errorf("Unsupported export format %v", format)
+		}
+		return format, nil
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		switch mediaType {
+		case "application/gpx+xml":
+			return "gpx", nil
+		case "application/vnd.google-earth.kml+xml":
+			return "kml", nil
+		case "application/geo+json", "application/json":
+			return "geojson", nil
+		}
+	}
+	return "gpx", nil
+}
+
+/*
+Feed the locations to the writer, starting a new track whenever the device changes
+*/
+func writeTrack(writer trackWriter, stream func(func(*Location) error) error) error {
+	err := writer.Begin()
+	if err != nil {
+		return err
+	}
+	var user, device string
+	inTrack := false
+	err = stream(func(location *Location) error {
+		if !inTrack || location.User != user || location.Device != device {
+			if inTrack {
+				if err := writer.EndTrack(); err != nil {
+					return err
+				}
+			}
+			user, device = location.User, location.Device
+			inTrack = true
+			if err := writer.StartTrack(user, device); err != nil {
+				return err
+			}
+		}
+		return writer.Point(location)
+	})
+	if err != nil {
+		return err
+	}
+	if inTrack {
+		err = writer.EndTrack()
+		if err != nil {
+			return err
+		}
+	}
+	return writer.End()
+}
+
+func xmlEscape(value string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(value))
+	return escaped.String()
+}
+
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+/*
+GPX 1.1, with speed in the Garmin track point extension
+*/
+type gpxWriter struct {
+	w io.Writer
+}
+
+func (writer *gpxWriter) Begin() error {
+	_, err := io.WriteString(writer.w, xml.Header+
+		`<gpx version="1.1" creator="www.growse.com" xmlns="http://www.topografix.com/GPX/1/1" `+
+		`xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v2" `+
+		`xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" `+
+		`xsi:schemaLocation="http://www.topografix.com/GPX/1/1 http://www.topografix.com/GPX/1/1/gpx.xsd">`+"\n")
+	return err
+}
+
+func (writer *gpxWriter) StartTrack(user string, device string) error {
+	_, err := fmt.Fprintf(writer.w, "<trk><name>%s/%s</name><trkseg>\n", xmlEscape(user), xmlEscape(device))
+	return err
+}
+
+func (writer *gpxWriter) Point(location *Location) error {
+	_, err := fmt.Fprintf(writer.w,
+		`<trkpt lat="%s" lon="%s"><ele>%s</ele><time>%s</time>`+
+			`<extensions><gpxtpx:TrackPointExtension><gpxtpx:speed>%s</gpxtpx:speed></gpxtpx:TrackPointExtension></extensions>`+
+			"</trkpt>\n",
+		formatCoordinate(location.Latitude),
+		formatCoordinate(location.Longitude),
+		strconv.FormatFloat(float64(location.Altitude), 'f', -1, 32),
+		location.DeviceTimestamp.UTC().Format(time.RFC3339),
+		// The locations query gives km/h, GPX wants m/s
+		strconv.FormatFloat(float64(location.Speed)/3.6, 'f', 2, 64))
+	return err
+}
+
+func (writer *gpxWriter) EndTrack() error {
+	_, err := io.WriteString(writer.w, "</trkseg></trk>\n")
+	return err
+}
+
+func (writer *gpxWriter) End() error {
+	_, err := io.WriteString(writer.w, "</gpx>\n")
+	return err
+}
+
+/*
+KML with a gx:Track per device, so each point keeps its time. Each point's when goes straight out followed by its
+coord, which Google Earth and other readers take in pairs, so nothing is held on to
+*/
+type kmlWriter struct {
+	w io.Writer
+}
+
+func (writer *kmlWriter) Begin() error {
+	_, err := io.WriteString(writer.w, xml.Header+
+		`<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2"><Document>`+"\n")
+	return err
+}
+
+func (writer *kmlWriter) StartTrack(user string, device string) error {
+	_, err := fmt.Fprintf(writer.w, "<Placemark><name>%s/%s</name><gx:Track><altitudeMode>absolute</altitudeMode>\n", xmlEscape(user), xmlEscape(device))
+	return err
+}
+
+func (writer *kmlWriter) Point(location *Location) error {
+	_, err := fmt.Fprintf(writer.w, "<when>%s</when><gx:coord>%s %s %s</gx:coord>\n",
+		location.DeviceTimestamp.UTC().Format(time.RFC3339),
+		formatCoordinate(location.Longitude),
+		formatCoordinate(location.Latitude),
+		strconv.FormatFloat(float64(location.Altitude), 'f', -1, 32))
+	return err
+}
+
+func (writer *kmlWriter) EndTrack() error {
+	_, err := io.WriteString(writer.w, "</gx:Track></Placemark>\n")
+	return err
+}
+
+func (writer *kmlWriter) End() error {
+	_, err := io.WriteString(writer.w, "</Document></kml>\n")
+	return err
+}
+
+/*
+Points in each GeoJSON feature. Times and speeds have to wait for the end of the feature, so this is as many as are
+ever held
+*/
+const geoJSONFeaturePoints = 1000
+
+/*
+A FeatureCollection of LineStrings per device. Times go in a coordTimes property alongside, as togeojson does. The
+coordinates go straight out, and a long track is split into features of at most geoJSONFeaturePoints, each starting
+where the last one ended so the line stays joined up
+*/
+type geoJSONTrackWriter struct {
+	w             io.Writer
+	featurePoints int
+	user          string
+	device        string
+	times         []string
+	speeds        []float64
+	previous      Location
+	firstFeature  bool
+}
+
+func (writer *geoJSONTrackWriter) Begin() error {
+	writer.firstFeature = true
+	if writer.featurePoints < 2 {
+		writer.featurePoints = geoJSONFeaturePoints
+	}
+	_, err := io.WriteString(writer.w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (writer *geoJSONTrackWriter) StartTrack(user string, device string) error {
+	writer.user, writer.device = user, device
+	return writer.startFeature()
+}
+
+func (writer *geoJSONTrackWriter) startFeature() error {
+	separator := ","
+	if writer.firstFeature {
+		separator = ""
+		writer.firstFeature = false
+	}
+	writer.times = writer.times[:0]
+	writer.speeds = writer.speeds[:0]
+	_, err := io.WriteString(writer.w, separator+"\n"+`{"type":"Feature","geometry":{"type":"LineString","coordinates":[`)
+	return err
+}
+
+func (writer *geoJSONTrackWriter) Point(location *Location) error {
+	if len(writer.times) == writer.featurePoints {
+		err := writer.EndTrack()
+		if err != nil {
+			return err
+		}
+		err = writer.startFeature()
+		if err != nil {
+			return err
+		}
+		err = writer.writePoint(&writer.previous)
+		if err != nil {
+			return err
+		}
+	}
+	writer.previous = *location
+	return writer.writePoint(location)
+}
+
+func (writer *geoJSONTrackWriter) writePoint(location *Location) error {
+	separator := ","
+	if len(writer.times) == 0 {
+		separator = ""
+	}
+	writer.times = append(writer.times, location.DeviceTimestamp.UTC().Format(time.RFC3339))
+	writer.speeds = append(writer.speeds, float64(location.Speed))
+	_, err := fmt.Fprintf(writer.w, "%s[%s,%s,%s]", separator,
+		formatCoordinate(location.Longitude),
+		formatCoordinate(location.Latitude),
+		strconv.FormatFloat(float64(location.Altitude), 'f', -1, 32))
+	return err
+}
+
+func (writer *geoJSONTrackWriter) EndTrack() error {
+	properties, err := json.Marshal(map[string]interface{}{
+		"username":   writer.user,
+		"device":     writer.device,
+		"coordTimes": writer.times,
+		"speeds":     writer.speeds,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer.w, `]},"properties":%s}`, properties)
+	return err
+}
+
+func (writer *geoJSONTrackWriter) End() error {
+	_, err := io.WriteString(writer.w, "\n]}\n")
+	return err
+}
+
+func OTExportHandler(c *gin.Context) {
+	const iso8061fmt = "2006-01-02T15:04:05"
+	from := c.DefaultQuery("from", time.Now().AddDate(0, 0, -1).Format(iso8061fmt))
+	to := c.DefaultQuery("to", time.Now().Format(iso8061fmt))
+	fromTime, err := time.Parse(iso8061fmt, from)
+	if err != nil {
+		c.String(400, fmt.Sprintf("Invalid from time %v: %v", from, err))
+		return
+	}
+	toTime, err := time.Parse(iso8061fmt, to)
+	if err != nil {
+		c.String(400, fmt.Sprintf("Invalid to time %v: %v", to, err))
+		return
+	}
+	format, err := exportFormat(c.Query("format"), c.GetHeader("Accept"))
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	if db == nil {
+		c.String(500, "No database connection available")
+		return
+	}
+	exporter := exportFormats[format]
+	c.Header("Content-Type", exporter.contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="locations-%s-%s.%s"`,
+		fromTime.Format("20060102T150405"), toTime.Format("20060102T150405"), exporter.extension))
+	c.Status(200)
+	buffered := bufio.NewWriter(c.Writer)
+	err = writeTrack(exporter.newWriter(buffered), func(each func(*Location) error) error {
+		return StreamLocationsBetweenDates(fromTime, toTime, c.Query("user"), c.Query("device"), "username, device, devicetimestamp", each)
+	})
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		// Too late to change the status, the client gets a truncated file
+		log.Printf("Error exporting locations: %v", err)
+	}
+}
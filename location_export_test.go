@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/paulmach/go.geojson"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func exportTestStream(each func(*Location) error) error {
+	start := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+	locations := []Location{
+		{User: "growse", Device: "nexus5", Latitude: 51.7472, Longitude: -0.4734, Altitude: 120, Speed: 36, DeviceTimestamp: start},
+		{User: "growse", Device: "nexus5", Latitude: 51.7480, Longitude: -0.4700, Altitude: 121, Speed: 36, DeviceTimestamp: start.Add(time.Minute)},
+		{User: "growse", Device: "pixel", Latitude: 48.8566, Longitude: 2.3522, Altitude: 35, DeviceTimestamp: start},
+	}
+	for i := range locations {
+		if err := each(&locations[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExportFormatComesFromParameterThenAcceptHeader(t *testing.T) {
+	format, err := exportFormat("KML", "application/gpx+xml")
+	assert.Nil(t, err)
+	assert.Equal(t, "kml", format)
+	format, err = exportFormat("", "text/html, application/geo+json;q=0.9")
+	assert.Nil(t, err)
+	assert.Equal(t, "geojson", format)
+	format, err = exportFormat("", "*/*")
+	assert.Nil(t, err)
+	assert.Equal(t, "gpx", format)
+	_, err = exportFormat("shp", "")
+	assert.NotNil(t, err)
+}
+
+func TestGPXExportHasATrackPerDevice(t *testing.T) {
+	var output bytes.Buffer
+	assert.Nil(t, writeTrack(&gpxWriter{w: &output}, exportTestStream))
+	var gpx struct {
+		Tracks []struct {
+			Name   string `xml:"name"`
+			Points []struct {
+				Latitude  float64 `xml:"lat,attr"`
+				Elevation float64 `xml:"ele"`
+				Time      string  `xml:"time"`
+				Speed     float64 `xml:"extensions>TrackPointExtension>speed"`
+			} `xml:"trkseg>trkpt"`
+		} `xml:"trk"`
+	}
+	assert.Nil(t, xml.Unmarshal(output.Bytes(), &gpx))
+	assert.Len(t, gpx.Tracks, 2)
+	assert.Equal(t, "growse/nexus5", gpx.Tracks[0].Name)
+	assert.Len(t, gpx.Tracks[0].Points, 2)
+	assert.Equal(t, 51.7472, gpx.Tracks[0].Points[0].Latitude)
+	assert.Equal(t, 120.0, gpx.Tracks[0].Points[0].Elevation)
+	assert.Equal(t, "2020-06-01T09:00:00Z", gpx.Tracks[0].Points[0].Time)
+	assert.Equal(t, 10.0, gpx.Tracks[0].Points[0].Speed)
+}
+
+func TestKMLExportWritesEachPointAsAWhenAndCoordPair(t *testing.T) {
+	var output bytes.Buffer
+	assert.Nil(t, writeTrack(&kmlWriter{w: &output}, exportTestStream))
+	var kml struct {
+		Placemarks []struct {
+			Name   string   `xml:"name"`
+			Whens  []string `xml:"Track>when"`
+			Coords []string `xml:"Track>coord"`
+		} `xml:"Document>Placemark"`
+	}
+	assert.Nil(t, xml.Unmarshal(output.Bytes(), &kml))
+	assert.Len(t, kml.Placemarks, 2)
+	assert.Equal(t, []string{"2020-06-01T09:00:00Z", "2020-06-01T09:01:00Z"}, kml.Placemarks[0].Whens)
+	assert.Equal(t, "-0.4734 51.7472 120", kml.Placemarks[0].Coords[0])
+	assert.Contains(t, output.String(), "<when>2020-06-01T09:00:00Z</when><gx:coord>-0.4734 51.7472 120</gx:coord>")
+}
+
+func TestGeoJSONExportIsALineStringPerDevice(t *testing.T) {
+	var output bytes.Buffer
+	assert.Nil(t, writeTrack(&geoJSONTrackWriter{w: &output}, exportTestStream))
+	featureCollection, err := geojson.UnmarshalFeatureCollection(output.Bytes())
+	assert.Nil(t, err)
+	assert.Len(t, featureCollection.Features, 2)
+	assert.True(t, featureCollection.Features[0].Geometry.IsLineString())
+	assert.Equal(t, []float64{-0.4734, 51.7472, 120}, featureCollection.Features[0].Geometry.LineString[0])
+	assert.Len(t, featureCollection.Features[0].Properties["coordTimes"], 2)
+	assert.Equal(t, "pixel", featureCollection.Features[1].Properties["device"])
+	assert.Len(t, featureCollection.Features[1].Properties["coordTimes"], 1)
+}
+
+func TestLongGeoJSONTracksAreSplitIntoJoinedUpFeatures(t *testing.T) {
+	var output bytes.Buffer
+	start := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+	assert.Nil(t, writeTrack(&geoJSONTrackWriter{w: &output, featurePoints: 2}, func(each func(*Location) error) error {
+		for i := 0; i < 3; i++ {
+			err := each(&Location{User: "growse", Device: "nexus5", Latitude: float64(i), DeviceTimestamp: start.Add(time.Duration(i) * time.Minute)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	featureCollection, err := geojson.UnmarshalFeatureCollection(output.Bytes())
+	assert.Nil(t, err)
+	assert.Len(t, featureCollection.Features, 2)
+	assert.Len(t, featureCollection.Features[0].Geometry.LineString, 2)
+	assert.Equal(t, featureCollection.Features[0].Geometry.LineString[1], featureCollection.Features[1].Geometry.LineString[0])
+	assert.Len(t, featureCollection.Features[1].Properties["coordTimes"], 2)
+	assert.Equal(t, "nexus5", featureCollection.Features[1].Properties["device"])
+}
+
+func TestEmptyExportsAreStillValid(t *testing.T) {
+	empty := func(each func(*Location) error) error { return nil }
+	var output bytes.Buffer
+	assert.Nil(t, writeTrack(&geoJSONTrackWriter{w: &output}, empty))
+	featureCollection, err := geojson.UnmarshalFeatureCollection(output.Bytes())
+	assert.Nil(t, err)
+	assert.Empty(t, featureCollection.Features)
+}
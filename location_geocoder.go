@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"net/url"
+)
+
+/*
+Provider independent address. This is what gets stored in the geocoding column, so naming, place search and the
+frontend don't care which provider produced it
+*/
+type Address struct {
+	Provider         string            `json:"provider"`
+	FormattedAddress string            `json:"formatted_address"`
+	HouseNumber      string            `json:"house_number,omitempty"`
+	Road             string            `json:"road,omitempty"`
+	Locality         string            `json:"locality,omitempty"`
+	PostalTown       string            `json:"postal_town,omitempty"`
+	County           string            `json:"county,omitempty"`
+	State            string            `json:"state,omitempty"`
+	Postcode         string            `json:"postcode,omitempty"`
+	Country          string            `json:"country,omitempty"`
+	CountryCode      string            `json:"country_code,omitempty"`
+	Type             string            `json:"type,omitempty"`
+	Latitude         float64           `json:"lat"`
+	Longitude        float64           `json:"lon"`
+	Bounds           *Bounds           `json:"bounds,omitempty"`
+	Geometry         *geojson.Geometry `json:"geometry,omitempty"`
+	Confidence       int               `json:"confidence,omitempty"`
+}
+
+type Bounds struct {
+	North float64 `json:"north"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	West  float64 `json:"west"`
+}
+
+/*
+The name we show for an address: the town if there is one, otherwise the locality
+*/
+func (address *Address) Name() string {
+	if address.PostalTown != "" {
+		return address.PostalTown
+	}
+	return address.Locality
+}
+
+/*
+The address as a GeoJSON feature, with its outline if the provider gave us one
+*/
+func (address *Address) Feature() (*geojson.Feature, error) {
+	geometry := address.Geometry
+	if geometry == nil {
+		geometry = geojson.NewPointGeometry([]float64{address.Longitude, address.Latitude})
+	}
+	withoutGeometry := *address
+	withoutGeometry.Geometry = nil
+	propertyBytes, err := json.Marshal(withoutGeometry)
+	if err != nil {
+		return nil, err
+	}
+	feature := geojson.NewFeature(geometry)
+	err = json.Unmarshal(propertyBytes, &feature.Properties)
+	if err != nil {
+		return nil, err
+	}
+	feature.SetProperty("name", address.Name())
+	return feature, nil
+}
+
+type Geocoder interface {
+	Name() string
+	Reverse(latitude float64, longitude float64) (*Address, error)
+	Search(query string) ([]Address, error)
+}
+
+/*
+A geocoder that's an HTTP API. The URLs are format strings taking (lat, lon) and the escaped query respectively
+*/
+type httpGeocoder struct {
+	name         string
+	reverseURL   string
+	searchURL    string
+	parseReverse func([]byte) (*Address, error)
+	parseSearch  func([]byte) ([]Address, error)
+}
+
+func (geocoder *httpGeocoder) Name() string {
+	return geocoder.name
+}
+
+func (geocoder *httpGeocoder) Reverse(latitude float64, longitude float64) (*Address, error) {
+	if geocoder.reverseURL == "" {
+		return nil, fmt.Errorf("no reverse geocoding URL configured for %v", geocoder.name)
+	}
+	response, err := fetchGeocodingResponse(fmt.Sprintf(geocoder.reverseURL, latitude, longitude))
+	if err != nil {
+		return nil, err
+	}
+	return geocoder.parseReverse([]byte(response))
+}
+
+func (geocoder *httpGeocoder) Search(query string) ([]Address, error) {
+	if geocoder.searchURL == "" {
+		return nil, fmt.Errorf("no geocoding URL configured for %v", geocoder.name)
+	}
+	response, err := fetchGeocodingResponse(fmt.Sprintf(geocoder.searchURL, url.QueryEscape(query)))
+	if err != nil {
+		return nil, err
+	}
+	return geocoder.parseSearch([]byte(response))
+}
+
+/*
+Builds the named provider. Blank URLs fall back to the provider's public endpoints where it has them
+*/
+func newGeocoder(provider string, reverseURL string, searchURL string) (Geocoder, error) {
+	switch provider {
+	case "google":
+		return newGoogleGeocoder(reverseURL, searchURL), nil
+	case "opencage":
+		return newOpenCageGeocoder(reverseURL, searchURL), nil
+	case "nominatim":
+		return newNominatimGeocoder(reverseURL, searchURL), nil
+	case "photon":
+		return newPhotonGeocoder(reverseURL, searchURL), nil
+	case "offline":
+		return newOfflineGeocoder(configuration.OfflineGeocoderPath)
+	}
+	return nil, fmt.Errorf("unknown geocoding provider %v", provider)
+}
+
+/*
+A reverse lookup answers with the best match, which providers put first
+*/
+func firstAddress(addresses []Address, err error) (*Address, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no geocoding results")
+	}
+	return &addresses[0], nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+/*
+Decode what's in the geocoding column. Rows from before providers were pluggable hold a raw Google response
+*/
+func parseStoredGeocoding(geocoding string) (*Address, error) {
+	if geocoding == "" {
+		return nil, errors.New("no geocoding")
+	}
+	var address Address
+	err := json.Unmarshal([]byte(geocoding), &address)
+	if err != nil {
+		return nil, err
+	}
+	if address.Provider != "" {
+		return &address, nil
+	}
+	return parseGoogleReverse([]byte(geocoding))
+}
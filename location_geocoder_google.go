@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type GeoLocation struct {
+	Status  string            `json:"status"`
+	Results []GeocodingResult `json:"results"`
+}
+
+type GeocodingResult struct {
+	AddressComponents []GeocodingAddressComponent `json:"address_components"`
+	FormattedAddress  string                      `json:"formatted_address"`
+	Types             []string                    `json:"types"`
+	Geometry          struct {
+		Location     googleLatLng  `json:"location"`
+		LocationType string        `json:"location_type"`
+		Bounds       *googleBounds `json:"bounds"`
+		Viewport     *googleBounds `json:"viewport"`
+	} `json:"geometry"`
+}
+
+type GeocodingAddressComponent struct {
+	LongName  string   `json:"long_name"`
+	ShortName string   `json:"short_name"`
+	Types     []string `json:"types"`
+}
+
+type googleLatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type googleBounds struct {
+	Northeast googleLatLng `json:"northeast"`
+	Southwest googleLatLng `json:"southwest"`
+}
+
+func (bounds *googleBounds) toBounds() *Bounds {
+	if bounds == nil {
+		return nil
+	}
+	return &Bounds{North: bounds.Northeast.Lat, South: bounds.Southwest.Lat, East: bounds.Northeast.Lng, West: bounds.Southwest.Lng}
+}
+
+func newGoogleGeocoder(reverseURL string, searchURL string) Geocoder {
+	return &httpGeocoder{
+		name:         "google",
+		reverseURL:   reverseURL,
+		searchURL:    searchURL,
+		parseReverse: parseGoogleReverse,
+		parseSearch:  parseGoogleSearch,
+	}
+}
+
+func parseGoogleReverse(response []byte) (*Address, error) {
+	return firstAddress(parseGoogleSearch(response))
+}
+
+func parseGoogleSearch(response []byte) ([]Address, error) {
+	var geoLocation GeoLocation
+	err := json.Unmarshal(response, &geoLocation)
+	if err != nil {
+		return nil, err
+	}
+	if geoLocation.Status == "ZERO_RESULTS" {
+		return []Address{}, nil
+	}
+	if geoLocation.Status != "OK" {
+		return nil, fmt.Errorf("google geocoding status %v", geoLocation.Status)
+	}
+	addresses := []Address{}
+	for _, result := range geoLocation.Results {
+		address := Address{
+			Provider:         "google",
+			FormattedAddress: result.FormattedAddress,
+			Latitude:         result.Geometry.Location.Lat,
+			Longitude:        result.Geometry.Location.Lng,
+			Bounds:           result.Geometry.Bounds.toBounds(),
+		}
+		if address.Bounds == nil {
+			address.Bounds = result.Geometry.Viewport.toBounds()
+		}
+		if len(result.Types) > 0 {
+			address.Type = result.Types[0]
+		}
+		switch result.Geometry.LocationType {
+		case "ROOFTOP":
+			address.Confidence = 10
+		case "RANGE_INTERPOLATED":
+			address.Confidence = 9
+		case "GEOMETRIC_CENTER":
+			address.Confidence = 8
+		}
+		for _, component := range result.AddressComponents {
+			switch {
+			case stringSliceContains(component.Types, "street_number"):
+				address.HouseNumber = component.LongName
+			case stringSliceContains(component.Types, "route"):
+				address.Road = component.LongName
+			case stringSliceContains(component.Types, "postal_town"):
+				address.PostalTown = component.LongName
+			case stringSliceContains(component.Types, "locality"):
+				address.Locality = component.LongName
+			case stringSliceContains(component.Types, "administrative_area_level_2"):
+				address.County = component.LongName
+			case stringSliceContains(component.Types, "administrative_area_level_1"):
+				address.State = component.LongName
+			case stringSliceContains(component.Types, "postal_code"):
+				address.Postcode = component.LongName
+			case stringSliceContains(component.Types, "country"):
+				address.Country = component.LongName
+				address.CountryCode = component.ShortName
+			}
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/paulmach/go.geojson"
+	"strconv"
+	"strings"
+)
+
+type nominatimResult struct {
+	Error       string            `json:"error"`
+	Lat         string            `json:"lat"`
+	Lon         string            `json:"lon"`
+	DisplayName string            `json:"display_name"`
+	Category    string            `json:"category"`
+	Type        string            `json:"type"`
+	Importance  float64           `json:"importance"`
+	BoundingBox []string          `json:"boundingbox"`
+	GeoJSON     *geojson.Geometry `json:"geojson"`
+	Address     struct {
+		HouseNumber string `json:"house_number"`
+		Road        string `json:"road"`
+		Hamlet      string `json:"hamlet"`
+		Village     string `json:"village"`
+		Suburb      string `json:"suburb"`
+		Town        string `json:"town"`
+		City        string `json:"city"`
+		County      string `json:"county"`
+		State       string `json:"state"`
+		Postcode    string `json:"postcode"`
+		Country     string `json:"country"`
+		CountryCode string `json:"country_code"`
+	} `json:"address"`
+}
+
+func newNominatimGeocoder(reverseURL string, searchURL string) Geocoder {
+	return &httpGeocoder{
+		name:         "nominatim",
+		reverseURL:   firstNonEmpty(reverseURL, "https://nominatim.openstreetmap.org/reverse?format=jsonv2&addressdetails=1&polygon_geojson=1&lat=%f&lon=%f"),
+		searchURL:    firstNonEmpty(searchURL, "https://nominatim.openstreetmap.org/search?format=jsonv2&addressdetails=1&polygon_geojson=1&q=%s"),
+		parseReverse: parseNominatimReverse,
+		parseSearch:  parseNominatimSearch,
+	}
+}
+
+func parseNominatimReverse(response []byte) (*Address, error) {
+	var result nominatimResult
+	err := json.Unmarshal(response, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	address := result.toAddress()
+	return &address, nil
+}
+
+func parseNominatimSearch(response []byte) ([]Address, error) {
+	var results []nominatimResult
+	err := json.Unmarshal(response, &results)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]Address, len(results))
+	for i, result := range results {
+		addresses[i] = result.toAddress()
+	}
+	return addresses, nil
+}
+
+func (result *nominatimResult) toAddress() Address {
+	address := Address{
+		Provider:         "nominatim",
+		FormattedAddress: result.DisplayName,
+		HouseNumber:      result.Address.HouseNumber,
+		Road:             result.Address.Road,
+		Locality:         firstNonEmpty(result.Address.City, result.Address.Town, result.Address.Village, result.Address.Hamlet, result.Address.Suburb),
+		PostalTown:       firstNonEmpty(result.Address.City, result.Address.Town),
+		County:           result.Address.County,
+		State:            result.Address.State,
+		Postcode:         result.Address.Postcode,
+		Country:          result.Address.Country,
+		CountryCode:      strings.ToUpper(result.Address.CountryCode),
+		Type:             result.Type,
+		Geometry:         result.GeoJSON,
+	}
+	address.Latitude, _ = strconv.ParseFloat(result.Lat, 64)
+	address.Longitude, _ = strconv.ParseFloat(result.Lon, 64)
+	// Nominatim's bounding box is [south, north, west, east]
+	if len(result.BoundingBox) == 4 {
+		var edges [4]float64
+		var err error
+		for i, edge := range result.BoundingBox {
+			edges[i], err = strconv.ParseFloat(edge, 64)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			address.Bounds = &Bounds{South: edges[0], North: edges[1], West: edges[2], East: edges[3]}
+		}
+	}
+	return address
+}
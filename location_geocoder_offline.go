@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Maximum distance in metres at which a populated place of each kind still names a location
+*/
+var offlinePlaceRadius = map[string]float64{
+	"city":    20000,
+	"town":    8000,
+	"suburb":  3000,
+	"village": 3000,
+	"hamlet":  1000,
+}
+
+const offlineDefaultPlaceRadius = 5000
+
+type offlineBoundary struct {
+	name        string
+	adminLevel  int
+	countryCode string
+	box         rtreeBox
+	geometry    *geojson.Geometry
+}
+
+type offlinePlace struct {
+	name      string
+	place     string
+	latitude  float64
+	longitude float64
+	radius    float64
+}
+
+/*
+Reverse geocodes from a local dataset, for when we can't call out to an API. The dataset is GeoJSON: polygon features
+are admin boundaries (with name and admin_level properties, as OpenStreetMap tags them) and point features are
+populated places (with name and place properties). Shapefiles can be converted with
+`ogr2ogr -f GeoJSON places.geojson places.shp`
+*/
+type offlineGeocoder struct {
+	boundaries   []offlineBoundary
+	boundaryTree *rtree
+	places       []offlinePlace
+	placeTree    *rtree
+}
+
+/*
+Loads a GeoJSON file, or every .geojson and .json file in a directory
+*/
+func newOfflineGeocoder(path string) (Geocoder, error) {
+	if path == "" {
+		return nil, errors.New("no offline geocoding dataset configured")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		for _, pattern := range []string{"*.geojson", "*.json"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+	geocoder := &offlineGeocoder{}
+	for _, file := range files {
+		err = geocoder.load(file)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %v: %v", file, err)
+		}
+	}
+	boundaryBoxes := make([]rtreeBox, len(geocoder.boundaries))
+	for i, boundary := range geocoder.boundaries {
+		boundaryBoxes[i] = boundary.box
+	}
+	placeBoxes := make([]rtreeBox, len(geocoder.places))
+	for i, place := range geocoder.places {
+		placeBoxes[i] = rtreeBox{MinX: place.longitude, MinY: place.latitude, MaxX: place.longitude, MaxY: place.latitude}
+	}
+	geocoder.boundaryTree = newRTree(boundaryBoxes)
+	geocoder.placeTree = newRTree(placeBoxes)
+	log.Printf("Loaded %d boundaries and %d places for offline geocoding", len(geocoder.boundaries), len(geocoder.places))
+	return geocoder, nil
+}
+
+func (geocoder *offlineGeocoder) load(file string) error {
+	fileBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	featureCollection, err := geojson.UnmarshalFeatureCollection(fileBytes)
+	if err != nil {
+		return err
+	}
+	for _, feature := range featureCollection.Features {
+		name := firstNonEmpty(feature.PropertyMustString("name", ""), feature.PropertyMustString("NAME", ""))
+		if name == "" || feature.Geometry == nil {
+			continue
+		}
+		switch {
+		case feature.Geometry.IsPoint():
+			place := offlinePlace{
+				name:      name,
+				place:     feature.PropertyMustString("place", ""),
+				longitude: feature.Geometry.Point[0],
+				latitude:  feature.Geometry.Point[1],
+			}
+			radius, ok := offlinePlaceRadius[place.place]
+			if !ok {
+				radius = offlineDefaultPlaceRadius
+			}
+			place.radius = radius
+			geocoder.places = append(geocoder.places, place)
+		case feature.Geometry.IsPolygon() || feature.Geometry.IsMultiPolygon():
+			box, ok := geometryBox(feature.Geometry)
+			if !ok {
+				continue
+			}
+			geocoder.boundaries = append(geocoder.boundaries, offlineBoundary{
+				name:        name,
+				adminLevel:  propertyInt(feature, "admin_level"),
+				countryCode: firstNonEmpty(feature.PropertyMustString("ISO3166-1", ""), feature.PropertyMustString("iso_a2", ""), feature.PropertyMustString("ISO_A2", "")),
+				box:         box,
+				geometry:    feature.Geometry,
+			})
+		}
+	}
+	return nil
+}
+
+/*
+OpenStreetMap exports admin_level as a string, other tools as a number
+*/
+func propertyInt(feature *geojson.Feature, name string) int {
+	switch value := feature.Properties[name].(type) {
+	case float64:
+		return int(value)
+	case string:
+		level, err := strconv.Atoi(value)
+		if err == nil {
+			return level
+		}
+	}
+	return 0
+}
+
+func (geocoder *offlineGeocoder) Name() string {
+	return "offline"
+}
+
+func (geocoder *offlineGeocoder) Reverse(latitude float64, longitude float64) (*Address, error) {
+	address := &Address{Provider: "offline", Latitude: latitude, Longitude: longitude}
+	var localBoundary string
+	localLevel := 0
+	for _, index := range geocoder.boundaryTree.Search(rtreeBox{MinX: longitude, MinY: latitude, MaxX: longitude, MaxY: latitude}) {
+		boundary := &geocoder.boundaries[index]
+		if !boundary.box.contains(longitude, latitude) || !geometryContains(boundary.geometry, longitude, latitude) {
+			continue
+		}
+		switch {
+		case boundary.adminLevel == 2:
+			address.Country = boundary.name
+			address.CountryCode = strings.ToUpper(boundary.countryCode)
+		case boundary.adminLevel == 4:
+			address.State = boundary.name
+		case boundary.adminLevel == 5 || boundary.adminLevel == 6:
+			if address.County == "" || boundary.adminLevel == 6 {
+				address.County = boundary.name
+			}
+		case boundary.adminLevel > 6 && boundary.adminLevel > localLevel:
+			localBoundary = boundary.name
+			localLevel = boundary.adminLevel
+		}
+	}
+
+	// Search a box that's big enough for the largest place radius
+	latitudeDelta := offlinePlaceRadius["city"] / 111320
+	longitudeDelta := latitudeDelta / math.Max(math.Cos(latitude*math.Pi/180), 0.01)
+	searchBox := rtreeBox{MinX: longitude - longitudeDelta, MinY: latitude - latitudeDelta, MaxX: longitude + longitudeDelta, MaxY: latitude + latitudeDelta}
+	townDistance, localityDistance := math.Inf(1), math.Inf(1)
+	for _, index := range geocoder.placeTree.Search(searchBox) {
+		place := &geocoder.places[index]
+		distance := haversineDistance(latitude, longitude, place.latitude, place.longitude)
+		if distance > place.radius {
+			continue
+		}
+		if (place.place == "city" || place.place == "town") && distance < townDistance {
+			address.PostalTown = place.name
+			townDistance = distance
+		}
+		if distance < localityDistance {
+			address.Locality = place.name
+			localityDistance = distance
+		}
+	}
+	if address.Locality == "" {
+		address.Locality = localBoundary
+	}
+
+	var parts []string
+	for _, part := range []string{address.Locality, address.PostalTown, address.County, address.State, address.Country} {
+		if part != "" && !stringSliceContains(parts, part) {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return nil, errors.New("location is outside the offline geocoding dataset")
+	}
+	address.FormattedAddress = strings.Join(parts, ", ")
+	return address, nil
+}
+
+/*
+Case insensitive name search. Exact matches come first, then prefix matches, larger places before smaller ones
+*/
+func (geocoder *offlineGeocoder) Search(query string) ([]Address, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return []Address{}, nil
+	}
+	type match struct {
+		address Address
+		exact   bool
+		size    float64
+	}
+	var matches []match
+	for _, place := range geocoder.places {
+		name := strings.ToLower(place.name)
+		if strings.HasPrefix(name, query) {
+			matches = append(matches, match{
+				address: Address{Provider: "offline", FormattedAddress: place.name, Locality: place.name, Type: place.place, Latitude: place.latitude, Longitude: place.longitude},
+				exact:   name == query,
+				size:    place.radius,
+			})
+		}
+	}
+	for _, boundary := range geocoder.boundaries {
+		name := strings.ToLower(boundary.name)
+		if strings.HasPrefix(name, query) {
+			box := boundary.box
+			matches = append(matches, match{
+				address: Address{
+					Provider:         "offline",
+					FormattedAddress: boundary.name,
+					Type:             "administrative",
+					Latitude:         (box.MinY + box.MaxY) / 2,
+					Longitude:        (box.MinX + box.MaxX) / 2,
+					Bounds:           &Bounds{North: box.MaxY, South: box.MinY, East: box.MaxX, West: box.MinX},
+					Geometry:         boundary.geometry,
+				},
+				exact: name == query,
+				size:  math.Inf(1),
+			})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].exact != matches[j].exact {
+			return matches[i].exact
+		}
+		return matches[i].size > matches[j].size
+	})
+	addresses := []Address{}
+	for i := 0; i < len(matches) && i < 10; i++ {
+		addresses = append(addresses, matches[i].address)
+	}
+	return addresses, nil
+}
+
+func geometryBox(geometry *geojson.Geometry) (rtreeBox, bool) {
+	box := rtreeBox{MinX: math.Inf(1), MinY: math.Inf(1), MaxX: math.Inf(-1), MaxY: math.Inf(-1)}
+	for _, polygon := range geometryPolygons(geometry) {
+		for _, ring := range polygon {
+			for _, point := range ring {
+				box = box.extend(rtreeBox{MinX: point[0], MinY: point[1], MaxX: point[0], MaxY: point[1]})
+			}
+		}
+	}
+	return box, box.MinX <= box.MaxX
+}
+
+func geometryPolygons(geometry *geojson.Geometry) [][][][]float64 {
+	if geometry.IsPolygon() {
+		return [][][][]float64{geometry.Polygon}
+	}
+	if geometry.IsMultiPolygon() {
+		return geometry.MultiPolygon
+	}
+	return nil
+}
+
+/*
+Point in (multi)polygon. The first ring of each polygon is its outline and the rest are holes
+*/
+func geometryContains(geometry *geojson.Geometry, x float64, y float64) bool {
+	for _, polygon := range geometryPolygons(geometry) {
+		if len(polygon) == 0 || !ringContains(polygon[0], x, y) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, x, y) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+func ringContains(ring [][]float64, x float64, y float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+/*
+Great circle distance in metres
+*/
+func haversineDistance(latitude1 float64, longitude1 float64, latitude2 float64, longitude2 float64) float64 {
+	const earthRadius = 6371000
+	phi1 := latitude1 * math.Pi / 180
+	phi2 := latitude2 * math.Pi / 180
+	deltaPhi := (latitude2 - latitude1) * math.Pi / 180
+	deltaLambda := (longitude2 - longitude1) * math.Pi / 180
+	a := math.Sin(deltaPhi/2)*math.Sin(deltaPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
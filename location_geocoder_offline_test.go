@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+const offlineTestDataset = `{"type":"FeatureCollection","features":[
+{"type":"Feature","properties":{"name":"United Kingdom","admin_level":"2","ISO3166-1":"gb"},"geometry":{"type":"Polygon","coordinates":[[[-8,49],[2,49],[2,59],[-8,59],[-8,49]]]}},
+{"type":"Feature","properties":{"name":"Hertfordshire","admin_level":6},"geometry":{"type":"MultiPolygon","coordinates":[[[[-0.8,51.6],[0.2,51.6],[0.2,52.1],[-0.8,52.1],[-0.8,51.6]],[[-0.3,51.9],[-0.2,51.9],[-0.2,52.0],[-0.3,52.0],[-0.3,51.9]]]]}},
+{"type":"Feature","properties":{"name":"Hemel Hempstead","place":"town"},"geometry":{"type":"Point","coordinates":[-0.4486,51.7532]}},
+{"type":"Feature","properties":{"name":"Boxmoor","place":"suburb"},"geometry":{"type":"Point","coordinates":[-0.4750,51.7470]}},
+{"type":"Feature","properties":{"name":"Hemel Hempstead Station","place":"locality"},"geometry":{"type":"Point","coordinates":[-0.4900,51.7420]}}
+]}`
+
+func newTestOfflineGeocoder(t *testing.T) Geocoder {
+	directory, err := ioutil.TempDir("", "offlinegeocoder")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(directory) })
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(directory, "places.geojson"), []byte(offlineTestDataset), 0600))
+	geocoder, err := newOfflineGeocoder(directory)
+	assert.Nil(t, err)
+	return geocoder
+}
+
+func TestOfflineReverseGeocodingNamesTheNearestTown(t *testing.T) {
+	address, err := newTestOfflineGeocoder(t).Reverse(51.7472, -0.4734)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hemel Hempstead", address.PostalTown)
+	assert.Equal(t, "Boxmoor", address.Locality)
+	assert.Equal(t, "Hertfordshire", address.County)
+	assert.Equal(t, "GB", address.CountryCode)
+	assert.Equal(t, "Hemel Hempstead", address.Name())
+}
+
+func TestOfflineReverseGeocodingHonoursHoles(t *testing.T) {
+	address, err := newTestOfflineGeocoder(t).Reverse(51.95, -0.25)
+	assert.Nil(t, err)
+	assert.Equal(t, "", address.County)
+	assert.Equal(t, "United Kingdom", address.Country)
+	assert.Equal(t, "", address.Name())
+}
+
+func TestOfflineReverseGeocodingOutsideTheDatasetIsAnError(t *testing.T) {
+	_, err := newTestOfflineGeocoder(t).Reverse(40.7, -74)
+	assert.NotNil(t, err)
+}
+
+func TestOfflineSearchPrefersExactMatches(t *testing.T) {
+	addresses, err := newTestOfflineGeocoder(t).Search("hemel hempstead")
+	assert.Nil(t, err)
+	assert.Len(t, addresses, 2)
+	assert.Equal(t, "Hemel Hempstead", addresses[0].FormattedAddress)
+	addresses, err = newTestOfflineGeocoder(t).Search("Hertford")
+	assert.Nil(t, err)
+	assert.Len(t, addresses, 1)
+	assert.NotNil(t, addresses[0].Bounds)
+}
+
+func TestRTreeSearchMatchesBruteForce(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	boxes := make([]rtreeBox, 1000)
+	for i := range boxes {
+		x, y := random.Float64()*100, random.Float64()*100
+		boxes[i] = rtreeBox{MinX: x, MinY: y, MaxX: x + random.Float64()*5, MaxY: y + random.Float64()*5}
+	}
+	tree := newRTree(boxes)
+	for i := 0; i < 50; i++ {
+		x, y := random.Float64()*100, random.Float64()*100
+		search := rtreeBox{MinX: x, MinY: y, MaxX: x + 3, MaxY: y + 3}
+		var expected, found []int
+		for index, box := range boxes {
+			if box.intersects(search) {
+				expected = append(expected, index)
+			}
+		}
+		for _, index := range tree.Search(search) {
+			if boxes[index].intersects(search) {
+				found = append(found, index)
+			}
+		}
+		sort.Ints(found)
+		assert.Equal(t, expected, found)
+	}
+}
+
+func TestEmptyRTreeFindsNothing(t *testing.T) {
+	assert.Empty(t, newRTree(nil).Search(rtreeBox{MaxX: 1, MaxY: 1}))
+}
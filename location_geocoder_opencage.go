@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/paulmach/go.geojson"
+	"strings"
+)
+
+type openCageResult struct {
+	Components map[string]interface{} `json:"components"`
+	Formatted  string                 `json:"formatted"`
+	Confidence int                    `json:"confidence"`
+	Geometry   struct {
+		Lat float64 `json:"lat"`
+		Lng float64 `json:"lng"`
+	} `json:"geometry"`
+	Bounds *googleBounds `json:"bounds"`
+}
+
+type openCageResponse struct {
+	Results []openCageResult `json:"results"`
+}
+
+func newOpenCageGeocoder(reverseURL string, searchURL string) Geocoder {
+	return &httpGeocoder{
+		name:         "opencage",
+		reverseURL:   reverseURL,
+		searchURL:    searchURL,
+		parseReverse: parseOpenCageReverse,
+		parseSearch:  parseOpenCageSearch,
+	}
+}
+
+func parseOpenCageReverse(response []byte) (*Address, error) {
+	return firstAddress(parseOpenCageSearch(response))
+}
+
+/*
+OpenCage answers in either its own JSON format or, with format=geojson, a FeatureCollection carrying the same fields as
+properties
+*/
+func parseOpenCageSearch(response []byte) ([]Address, error) {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	err := json.Unmarshal(response, &typed)
+	if err != nil {
+		return nil, err
+	}
+	var results []openCageResult
+	if typed.Type == "FeatureCollection" {
+		featureCollection, err := geojson.UnmarshalFeatureCollection(response)
+		if err != nil {
+			return nil, err
+		}
+		for _, feature := range featureCollection.Features {
+			properties, err := json.Marshal(feature.Properties)
+			if err != nil {
+				return nil, err
+			}
+			var result openCageResult
+			err = json.Unmarshal(properties, &result)
+			if err != nil {
+				return nil, err
+			}
+			if feature.Geometry != nil && feature.Geometry.IsPoint() {
+				result.Geometry.Lng = feature.Geometry.Point[0]
+				result.Geometry.Lat = feature.Geometry.Point[1]
+			}
+			results = append(results, result)
+		}
+	} else {
+		var openCage openCageResponse
+		err = json.Unmarshal(response, &openCage)
+		if err != nil {
+			return nil, err
+		}
+		results = openCage.Results
+	}
+	addresses := make([]Address, len(results))
+	for i, result := range results {
+		addresses[i] = result.toAddress()
+	}
+	return addresses, nil
+}
+
+func (result *openCageResult) component(names ...string) string {
+	for _, name := range names {
+		if value, ok := result.Components[name].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (result *openCageResult) toAddress() Address {
+	return Address{
+		Provider:         "opencage",
+		FormattedAddress: result.Formatted,
+		HouseNumber:      result.component("house_number"),
+		Road:             result.component("road"),
+		Locality:         result.component("city", "town", "village", "hamlet", "suburb"),
+		PostalTown:       result.component("postal_city", "city", "town"),
+		County:           result.component("county"),
+		State:            result.component("state"),
+		Postcode:         result.component("postcode"),
+		Country:          result.component("country"),
+		CountryCode:      strings.ToUpper(result.component("country_code")),
+		Type:             result.component("_type"),
+		Latitude:         result.Geometry.Lat,
+		Longitude:        result.Geometry.Lng,
+		Bounds:           result.Bounds.toBounds(),
+		Confidence:       result.Confidence,
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/paulmach/go.geojson"
+	"strings"
+)
+
+func newPhotonGeocoder(reverseURL string, searchURL string) Geocoder {
+	return &httpGeocoder{
+		name:         "photon",
+		reverseURL:   firstNonEmpty(reverseURL, "https://photon.komoot.io/reverse?lat=%f&lon=%f"),
+		searchURL:    firstNonEmpty(searchURL, "https://photon.komoot.io/api/?q=%s"),
+		parseReverse: parsePhotonReverse,
+		parseSearch:  parsePhotonSearch,
+	}
+}
+
+func parsePhotonReverse(response []byte) (*Address, error) {
+	return firstAddress(parsePhotonSearch(response))
+}
+
+func parsePhotonSearch(response []byte) ([]Address, error) {
+	featureCollection, err := geojson.UnmarshalFeatureCollection(response)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]Address, 0, len(featureCollection.Features))
+	for _, feature := range featureCollection.Features {
+		address := Address{
+			Provider:    "photon",
+			HouseNumber: feature.PropertyMustString("housenumber", ""),
+			Road:        feature.PropertyMustString("street", ""),
+			Locality:    firstNonEmpty(feature.PropertyMustString("city", ""), feature.PropertyMustString("district", "")),
+			PostalTown:  feature.PropertyMustString("city", ""),
+			County:      feature.PropertyMustString("county", ""),
+			State:       feature.PropertyMustString("state", ""),
+			Postcode:    feature.PropertyMustString("postcode", ""),
+			Country:     feature.PropertyMustString("country", ""),
+			CountryCode: strings.ToUpper(feature.PropertyMustString("countrycode", "")),
+			Type:        feature.PropertyMustString("osm_value", ""),
+		}
+		if feature.Geometry != nil && feature.Geometry.IsPoint() {
+			address.Longitude = feature.Geometry.Point[0]
+			address.Latitude = feature.Geometry.Point[1]
+		}
+		// Photon's extent is [minLon, maxLat, maxLon, minLat]
+		if extent, ok := feature.Properties["extent"].([]interface{}); ok && len(extent) == 4 {
+			var edges [4]float64
+			valid := true
+			for i, edge := range extent {
+				edges[i], ok = edge.(float64)
+				valid = valid && ok
+			}
+			if valid {
+				address.Bounds = &Bounds{West: edges[0], North: edges[1], East: edges[2], South: edges[3]}
+			}
+		}
+		var parts []string
+		name := feature.PropertyMustString("name", "")
+		if name != "" {
+			parts = append(parts, name)
+		}
+		if address.Road != "" && address.Road != name {
+			parts = append(parts, strings.TrimSpace(address.HouseNumber+" "+address.Road))
+		}
+		for _, part := range []string{address.Locality, address.Postcode, address.Country} {
+			if part != "" && part != name {
+				parts = append(parts, part)
+			}
+		}
+		address.FormattedAddress = strings.Join(parts, ", ")
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNominatimReverseIsNormalized(t *testing.T) {
+	response := `{"place_id":123,"lat":"51.7532","lon":"-0.4486","category":"place","type":"town","display_name":"Hemel Hempstead, Dacorum, Hertfordshire, England, United Kingdom","address":{"town":"Hemel Hempstead","county":"Hertfordshire","state":"England","postcode":"HP1 1AA","country":"United Kingdom","country_code":"gb"},"boundingbox":["51.7245","51.7829","-0.5173","-0.4111"]}`
+	address, err := parseNominatimReverse([]byte(response))
+	assert.Nil(t, err)
+	assert.Equal(t, "nominatim", address.Provider)
+	assert.Equal(t, "Hemel Hempstead", address.Name())
+	assert.Equal(t, "GB", address.CountryCode)
+	assert.Equal(t, 51.7532, address.Latitude)
+	assert.Equal(t, &Bounds{North: 51.7829, South: 51.7245, East: -0.4111, West: -0.5173}, address.Bounds)
+}
+
+func TestNominatimReverseErrorIsReturned(t *testing.T) {
+	_, err := parseNominatimReverse([]byte(`{"error":"Unable to geocode"}`))
+	assert.EqualError(t, err, "Unable to geocode")
+}
+
+func TestPhotonSearchIsNormalized(t *testing.T) {
+	response := `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-0.4486,51.7532]},"properties":{"name":"Hemel Hempstead","city":"Hemel Hempstead","county":"Hertfordshire","country":"United Kingdom","countrycode":"GB","osm_value":"town","extent":[-0.5173,51.7829,-0.4111,51.7245]}}]}`
+	addresses, err := parsePhotonSearch([]byte(response))
+	assert.Nil(t, err)
+	assert.Len(t, addresses, 1)
+	assert.Equal(t, "Hemel Hempstead", addresses[0].Name())
+	assert.Equal(t, "Hemel Hempstead, United Kingdom", addresses[0].FormattedAddress)
+	assert.Equal(t, -0.4486, addresses[0].Longitude)
+	assert.Equal(t, &Bounds{North: 51.7829, South: 51.7245, East: -0.4111, West: -0.5173}, addresses[0].Bounds)
+}
+
+func TestOpenCageGeoJSONSearchIsNormalized(t *testing.T) {
+	response := `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-0.4486,51.7532]},"properties":{"formatted":"Hemel Hempstead, United Kingdom","confidence":7,"components":{"_type":"city","town":"Hemel Hempstead","country":"United Kingdom","country_code":"gb"},"bounds":{"northeast":{"lat":51.7829,"lng":-0.4111},"southwest":{"lat":51.7245,"lng":-0.5173}}}}]}`
+	addresses, err := parseOpenCageSearch([]byte(response))
+	assert.Nil(t, err)
+	assert.Len(t, addresses, 1)
+	assert.Equal(t, "Hemel Hempstead", addresses[0].Name())
+	assert.Equal(t, 7, addresses[0].Confidence)
+	assert.Equal(t, 51.7532, addresses[0].Latitude)
+	assert.Equal(t, &Bounds{North: 51.7829, South: 51.7245, East: -0.4111, West: -0.5173}, addresses[0].Bounds)
+}
+
+func TestOpenCageJSONReverseIsNormalized(t *testing.T) {
+	response := `{"results":[{"formatted":"1 High Street, Hemel Hempstead HP1 1AA, United Kingdom","confidence":10,"components":{"house_number":"1","road":"High Street","postal_city":"Hemel Hempstead","village":"Boxmoor","postcode":"HP1 1AA"},"geometry":{"lat":51.75,"lng":-0.47}}]}`
+	address, err := parseOpenCageReverse([]byte(response))
+	assert.Nil(t, err)
+	assert.Equal(t, "Hemel Hempstead", address.Name())
+	assert.Equal(t, "Boxmoor", address.Locality)
+	assert.Nil(t, address.Bounds)
+}
+
+func TestGoogleReverseIsNormalized(t *testing.T) {
+	response := `{"status":"OK","results":[{"formatted_address":"Hemel Hempstead, UK","types":["locality"],"geometry":{"location":{"lat":51.753241,"lng":-0.448632},"viewport":{"northeast":{"lat":51.78,"lng":-0.41},"southwest":{"lat":51.72,"lng":-0.51}}},"address_components":[{"types":["locality"],"long_name":"Hemel Hempstead","short_name":"Hemel Hempstead"},{"types":["country","political"],"long_name":"United Kingdom","short_name":"GB"}]}]}`
+	address, err := parseGoogleReverse([]byte(response))
+	assert.Nil(t, err)
+	assert.Equal(t, "Hemel Hempstead", address.Name())
+	assert.Equal(t, "GB", address.CountryCode)
+	assert.Equal(t, &Bounds{North: 51.78, South: 51.72, East: -0.41, West: -0.51}, address.Bounds)
+}
+
+func TestStoredNormalizedAddressNames(t *testing.T) {
+	location := Location{Geocoding: `{"provider":"nominatim","formatted_address":"Somewhere","locality":"Boxmoor","lat":51.75,"lon":-0.47}`}
+	assert.Equal(t, "Boxmoor", location.Name())
+}
+
+func TestUnknownGeocodingProviderIsAnError(t *testing.T) {
+	_, err := newGeocoder("mapquest", "", "")
+	assert.NotNil(t, err)
+}
@@ -4,69 +4,33 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/paulmach/go.geojson"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"time"
 )
 
-type GeoLocation struct {
-	Status  string            `json:"status"`
-	Results []GeocodingResult `json:"results"`
-}
-
-type GeocodingResult struct {
-	AddressComponents []GeocodingAddressComponent `json:"address_components"`
-}
-
-type GeocodingAddressComponent struct {
-	LongName  string   `json:"long_name"`
-	ShortName string   `json:"short_name"`
-	Types     []string `json:"types"`
-}
-
 /*
 Extract a sane name from the geocoding object
 */
 func (location *Location) Name() string {
 	unknownLocation := "Unknown"
-	var geoLocation GeoLocation
-	err := json.Unmarshal([]byte(location.Geocoding), &geoLocation)
+	address, err := parseStoredGeocoding(location.Geocoding)
 	if err != nil {
 		log.Printf("Error decoding location object: %v", err)
 		log.Printf("%v", location.Geocoding)
-		return "Unknown"
-	}
-
-	if geoLocation.Status != "OK" || len(geoLocation.Results) == 0 {
 		return unknownLocation
 	}
-
-	var postalTown, locality string
-
-	for _, addresscomponents := range geoLocation.Results[0].AddressComponents {
-		if stringSliceContains(addresscomponents.Types, "postal_town") {
-			postalTown = addresscomponents.LongName
-		}
-		if stringSliceContains(addresscomponents.Types, "locality") {
-			locality = addresscomponents.LongName
-		}
-	}
-	if postalTown != "" {
-		return postalTown
-	}
-	if locality != "" {
-		return locality
+	name := address.Name()
+	if name == "" {
+		return unknownLocation
 	}
-	return unknownLocation
-
+	return name
 }
 
-func GetGeocoding(place string) (*geojson.FeatureCollection, error) {
-	if configuration.GeocodeApiURL == "" {
-		err := errors.New("Geocoding API should not be blank")
+func GetGeocoding(place string) ([]Address, error) {
+	if forwardGeocoder == nil {
+		err := errors.New("No geocoding provider configured")
 		InternalError(err)
 		return nil, err
 	}
@@ -75,32 +39,62 @@ func GetGeocoding(place string) (*geojson.FeatureCollection, error) {
 		InternalError(err)
 		return nil, err
 	}
-	geocodingUrl := fmt.Sprintf(configuration.GeocodeApiURL, url.QueryEscape(place))
-
-	geocodingResponse, err := fetchGeocodingResponse(geocodingUrl)
+	geocodingResponse, err := cachedGeocoding(forwardGeocoder.Name()+":"+forwardGeocodingCacheKey(place), func() (string, error) {
+		addresses, err := forwardGeocoder.Search(place)
+		if err != nil {
+			return "", err
+		}
+		addressBytes, err := json.Marshal(addresses)
+		return string(addressBytes), err
+	})
 	if err != nil {
+		InternalError(err)
 		return nil, err
 	}
-	featureColletion, err := geojson.UnmarshalFeatureCollection([]byte(geocodingResponse))
+	var addresses []Address
+	err = json.Unmarshal([]byte(geocodingResponse), &addresses)
 	if err != nil {
 		return nil, err
 	}
-	return featureColletion, nil
+	return addresses, nil
 }
 
+/*
+Reverse geocode the location, returning the normalized address as JSON ready for the geocoding column
+*/
 func (location *Location) GetReverseGeocoding() (string, error) {
-	if configuration.ReverseGeocodeApiURL == "" {
-		err := errors.New("Reverse Geocoding API should not be blank")
-		InternalError(err)
+	if reverseGeocoder == nil {
+		return "", errors.New("No reverse geocoding provider configured")
+	}
+	if reverseGeocoder.Name() == "offline" {
+		// Local lookups are cheap enough to not need rate limiting or caching
+		return reverseGeocodeToJSON(reverseGeocoder, location.Latitude, location.Longitude)
+	}
+	cacheKey := reverseGeocoder.Name() + ":" + reverseGeocodingCacheKey(location.Latitude, location.Longitude, configuration.GeocodingCacheDecimals)
+	return cachedGeocoding(cacheKey, func() (string, error) {
+		reverseGeocodingLimiter.Wait()
+		return reverseGeocodeToJSON(reverseGeocoder, location.Latitude, location.Longitude)
+	})
+}
+
+func reverseGeocodeToJSON(geocoder Geocoder, latitude float64, longitude float64) (string, error) {
+	address, err := geocoder.Reverse(latitude, longitude)
+	if err != nil {
 		return "", err
 	}
-	geocodingUrl := fmt.Sprintf(configuration.ReverseGeocodeApiURL, location.Latitude, location.Longitude)
-	return fetchGeocodingResponse(geocodingUrl)
+	addressBytes, err := json.Marshal(address)
+	return string(addressBytes), err
 }
 
 func fetchGeocodingResponse(geocodingUrl string) (string, error) {
 	defer timeTrack(time.Now())
-	response, err := http.Get(geocodingUrl)
+	request, err := http.NewRequest("GET", geocodingUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	// Nominatim's usage policy requires an identifying user agent
+	request.Header.Set("User-Agent", "www.growse.com location tracker")
+	response, err := http.DefaultClient.Do(request)
 
 	if err != nil {
 		log.Printf("Error getting geolocation from API: %v", err)
@@ -114,87 +108,37 @@ func fetchGeocodingResponse(geocodingUrl string) (string, error) {
 			body = []byte("")
 		}
 		err := errors.New(fmt.Sprintf("invalid response from Geolocation API: %v %v", response.StatusCode, body))
-		InternalError(err)
+		log.Print(err)
 		return "", err
 	}
 
 	if err != nil {
-		InternalError(err)
+		log.Printf("Error reading geolocation response: %v", err)
 		return "", err
 	}
 	return string(body), nil
 }
 
-func UpdateLatestLocationWithGeocoding(workChan <-chan bool) {
-	log.Print("Starting geocoding goroutine")
-	for {
-		_, more := <-workChan
-		if more {
-			log.Print("Updating latest geocoding")
-			var location Location
-			var id int
-			err := db.QueryRow("select id,ST_Y(ST_AsText(point)),ST_X(ST_AsText(point)) from locations order by devicetimestamp desc limit 1").Scan(&id, &location.Latitude, &location.Longitude)
-			if err != nil {
-				InternalError(err)
-			}
-			tx, err := db.Begin()
-			if err != nil {
-				InternalError(err)
-			}
-			geocoding, err := location.GetReverseGeocoding()
-			if err != nil {
-				InternalError(err)
-			} else {
-				_, err = tx.Exec("update locations set geocoding=$1 where id=$2", geocoding, id)
-				if err != nil {
-					log.Printf("Location that caused fail is: %s", geocoding)
-					tx.Rollback()
-					InternalError(err)
-				}
-				err = tx.Commit()
-				if err != nil {
-					InternalError(err)
-				} else {
-					log.Print("Geocoding complete")
-				}
-			}
-		} else {
-			log.Print("Got signal, quitting geocoding goroutine.")
-			return
-		}
-
+/*
+Reverse geocode a single location and store the result against it. Errors are left to the caller to report, as the
+queue retries them
+*/
+func UpdateLocationWithGeocoding(id int64) error {
+	if db == nil {
+		return errors.New("No database connection available")
 	}
-}
-
-func GeocodingCrawler(quitChan <-chan bool) {
-	log.Print("Starting geocoding backlog crawler")
-	ticker := time.NewTicker(10 * time.Second)
-	for {
-		select {
-		case <-ticker.C:
-			var location Location
-			var id int
-			err := db.QueryRow("select id,ST_Y(ST_AsText(point)),ST_X(ST_AsText(point)) from locations where geocoding is null and devicetimestamp<CURRENT_DATE - 1 order by devicetimestamp desc limit 1").Scan(&id, &location.Latitude, &location.Longitude)
-			if err != nil {
-				log.Print("Error fetching latest location without geocode")
-				break
-			}
-			geocoding, err := location.GetReverseGeocoding()
-			if err != nil {
-				log.Printf("Error reversing geocode for: %v", location)
-				break
-			} else {
-				_, err = db.Exec("update locations set geocoding=$1 where id=$2", geocoding, id)
-				if err != nil {
-					log.Printf("Location that caused fail is: %s", geocoding)
-				} else {
-					log.Printf("Geocoded location id=%v", id)
-				}
-			}
-		case <-quitChan:
-
-			log.Print("Clos")
-			return
-		}
+	var location Location
+	err := db.QueryRow("select ST_Y(ST_AsText(point)),ST_X(ST_AsText(point)) from locations where id=$1", id).Scan(&location.Latitude, &location.Longitude)
+	if err != nil {
+		return err
+	}
+	geocoding, err := location.GetReverseGeocoding()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("update locations set geocoding=$1 where id=$2", geocoding, id)
+	if err != nil {
+		log.Printf("Location that caused fail is: %s", geocoding)
 	}
+	return err
 }
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type GeocodingBackfillOptions struct {
+	Rate      float64   `json:"rate"`
+	BatchSize int       `json:"batchSize"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Regeocode string    `json:"regeocode,omitempty"`
+	// Only locations stored since then, plus anything imported. Used by the sweep
+	InsertedSince time.Time `json:"insertedSince,omitempty"`
+	// Leave out locations the queue has given up on this many times. Used by the sweep
+	MaxFailures int `json:"maxFailures,omitempty"`
+}
+
+type GeocodingBackfillStatus struct {
+	Running   bool                     `json:"running"`
+	Options   GeocodingBackfillOptions `json:"options"`
+	Started   time.Time                `json:"started"`
+	Finished  time.Time                `json:"finished"`
+	Total     int64                    `json:"total"`
+	Queued    int64                    `json:"queued"`
+	Done      int64                    `json:"done"`
+	Errors    int64                    `json:"errors"`
+	Skipped   int64                    `json:"skipped"`
+	Remaining int64                    `json:"remaining"`
+	LastError string                   `json:"lastError,omitempty"`
+}
+
+/*
+Works through locations that need geocoding, either because they never were or because they were geocoded by a
+provider other than the one asked for. Locations go on the backlog side of the geocoding queue, so live locations still
+go first
+*/
+type GeocodingBackfill struct {
+	queue  *GeocodingQueue
+	mutex  sync.Mutex
+	status GeocodingBackfillStatus
+	stop   chan bool
+	quit   <-chan bool
+	// Bumped by every Start, so a stopped run still draining can't touch the status of the one after it
+	generation int
+}
+
+func NewGeocodingBackfill(queue *GeocodingQueue, quit <-chan bool) *GeocodingBackfill {
+	return &GeocodingBackfill{queue: queue, quit: quit}
+}
+
+func (backfill *GeocodingBackfill) Start(options GeocodingBackfillOptions) error {
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+	if backfill.status.Running {
+		return errors.New("geocoding backfill is already running")
+	}
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+	backfill.generation++
+	backfill.status = GeocodingBackfillStatus{Running: true, Options: options, Started: time.Now()}
+	backfill.stop = make(chan bool)
+	go backfill.run(backfill.generation, options, backfill.stop, backfill.quit)
+	return nil
+}
+
+/*
+Stops queueing more locations, and a new backfill can be started straight away. Anything already queued still gets
+geocoded, and still counts towards this one's status until then
+*/
+func (backfill *GeocodingBackfill) Stop() bool {
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+	if !backfill.status.Running || backfill.stop == nil {
+		return false
+	}
+	close(backfill.stop)
+	backfill.stop = nil
+	backfill.status.Running = false
+	backfill.status.Finished = time.Now()
+	return true
+}
+
+func (backfill *GeocodingBackfill) Status() GeocodingBackfillStatus {
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+	status := backfill.status
+	status.Remaining = status.Total - status.Done - status.Errors - status.Skipped
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	return status
+}
+
+/*
+Changes the status, as long as it still belongs to the given run
+*/
+func (backfill *GeocodingBackfill) update(generation int, change func(status *GeocodingBackfillStatus)) {
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+	if generation == backfill.generation {
+		change(&backfill.status)
+	}
+}
+
+func (backfill *GeocodingBackfill) run(generation int, options GeocodingBackfillOptions, stop <-chan bool, quit <-chan bool) {
+	log.Printf("Starting geocoding backfill: %+v", options)
+	defer backfill.update(generation, func(status *GeocodingBackfillStatus) {
+		if status.Running {
+			status.Running = false
+			status.Finished = time.Now()
+			backfill.stop = nil
+		}
+	})
+	// Either stopping or quitting means no more queueing
+	cancel := make(chan bool)
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-stop:
+		case <-quit:
+		case <-finished:
+		}
+		close(cancel)
+	}()
+
+	total, err := countGeocodingBackfill(options)
+	if err != nil {
+		log.Printf("Error counting locations to geocode: %v", err)
+		backfill.update(generation, func(status *GeocodingBackfillStatus) { status.LastError = err.Error() })
+		return
+	}
+	backfill.update(generation, func(status *GeocodingBackfillStatus) { status.Total = total })
+
+	limiter := newRateLimiter(options.Rate)
+	var outstanding sync.WaitGroup
+	done := func(err error) {
+		backfill.update(generation, func(status *GeocodingBackfillStatus) {
+			if err != nil {
+				status.Errors++
+				status.LastError = err.Error()
+			} else {
+				status.Done++
+			}
+		})
+		outstanding.Done()
+	}
+	cursor := int64(math.MaxInt64)
+queueing:
+	for {
+		ids, err := fetchGeocodingBackfillBatch(options, cursor)
+		if err != nil {
+			log.Printf("Error fetching locations to geocode: %v", err)
+			backfill.update(generation, func(status *GeocodingBackfillStatus) { status.LastError = err.Error() })
+			break
+		}
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			cursor = id
+			limiter.Wait()
+			select {
+			case <-cancel:
+				break queueing
+			default:
+			}
+			outstanding.Add(1)
+			queued := id
+			finished := func(err error) {
+				if err != nil {
+					recordGeocodingFailure(queued)
+				}
+				done(err)
+			}
+			if backfill.queue.EnqueueBacklog(id, finished, cancel) {
+				backfill.update(generation, func(status *GeocodingBackfillStatus) { status.Queued++ })
+			} else {
+				// Already being geocoded from the live side, or we've been cancelled
+				outstanding.Done()
+				backfill.update(generation, func(status *GeocodingBackfillStatus) { status.Skipped++ })
+			}
+		}
+	}
+
+	waited := make(chan bool)
+	go func() {
+		outstanding.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		log.Printf("Geocoding backfill finished: %+v", backfill.Status())
+	case <-quit:
+		log.Print("Got signal, quitting geocoding backfill.")
+	}
+}
+
+/*
+The where clause picking out locations the backfill should geocode. Numbering of placeholders carries on from args
+*/
+func geocodingBackfillConditions(options GeocodingBackfillOptions, args []interface{}) (string, []interface{}) {
+	// Nobody sees excluded fixes, so there's no point paying to geocode them
+	conditions := []string{"not excluded"}
+	if options.Regeocode == "" {
+		conditions = append(conditions, "geocoding is null")
+	} else {
+		// Rows from before providers were pluggable are raw Google responses
+		args = append(args, options.Regeocode)
+		conditions = append(conditions, fmt.Sprintf("(geocoding is null or coalesce(geocoding ->> 'provider', 'google') != $%d)", len(args)))
+	}
+	if !options.From.IsZero() {
+		args = append(args, options.From)
+		conditions = append(conditions, fmt.Sprintf("devicetimestamp >= $%d", len(args)))
+	}
+	if !options.To.IsZero() {
+		args = append(args, options.To)
+		conditions = append(conditions, fmt.Sprintf("devicetimestamp < $%d", len(args)))
+	}
+	if !options.InsertedSince.IsZero() {
+		// Imports can be far bigger than a sweep gets through, so they stay in every sweep until they're done
+		args = append(args, options.InsertedSince)
+		conditions = append(conditions, fmt.Sprintf("(timestamp >= $%d or source is not null)", len(args)))
+	}
+	if options.MaxFailures > 0 {
+		args = append(args, options.MaxFailures)
+		conditions = append(conditions, fmt.Sprintf("not exists (select 1 from geocodingfailures where locationid = locations.id and attempts >= $%d)", len(args)))
+	}
+	return strings.Join(conditions, " and "), args
+}
+
+/*
+Counts the queue giving up on a location. Only ever logs, as the backfill carries on either way
+*/
+func recordGeocodingFailure(id int64) {
+	if db == nil {
+		return
+	}
+	_, err := db.Exec("insert into geocodingfailures (locationid, attempts, lastattempt) values ($1, 1, now()) "+
+		"on conflict (locationid) do update set attempts = geocodingfailures.attempts + 1, lastattempt = now()", id)
+	if err != nil {
+		log.Printf("Error recording geocoding failure for location id=%v: %v", id, err)
+	}
+}
+
+func countGeocodingBackfill(options GeocodingBackfillOptions) (int64, error) {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return 0, errors.New("No database connection available")
+	}
+	conditions, args := geocodingBackfillConditions(options, nil)
+	var count int64
+	err := db.QueryRow("select count(*) from locations where "+conditions, args...).Scan(&count)
+	return count, err
+}
+
+/*
+Newest first, paging on id so that locations that fail to geocode aren't fetched again
+*/
+func fetchGeocodingBackfillBatch(options GeocodingBackfillOptions, before int64) ([]int64, error) {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	conditions, args := geocodingBackfillConditions(options, []interface{}{before, options.BatchSize})
+	rows, err := db.Query("select id from locations where id < $1 and "+conditions+" order by id desc limit $2", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func defaultGeocodingBackfillOptions() GeocodingBackfillOptions {
+	return GeocodingBackfillOptions{
+		Rate:      configuration.GeocodingBackfillRate,
+		BatchSize: configuration.GeocodingBatchSize,
+	}
+}
+
+/*
+How far back a sweep looks for live locations that didn't get geocoded
+*/
+const geocodingSweepLookback = 24 * time.Hour
+
+/*
+Sweeps that fail to geocode a location before it's left alone. A backfill started by hand still tries it
+*/
+const geocodingSweepMaxFailures = 3
+
+/*
+What the sweep covers. With the crawler on that's all of history, otherwise it's whatever the live queue dropped or
+gave up on recently, and imports
+*/
+func geocodingSweepOptions() GeocodingBackfillOptions {
+	options := defaultGeocodingBackfillOptions()
+	options.MaxFailures = geocodingSweepMaxFailures
+	if !configuration.EnableGeocodingCrawler {
+		options.InsertedSince = time.Now().Add(-geocodingSweepLookback)
+	}
+	return options
+}
+
+/*
+Starts a backfill with the given options every interval, unless one's already running. The first is straight away.
+Sweeps get a GeocodingBackfill of their own, so they don't hold up or overwrite the status of one started by hand
+*/
+func (backfill *GeocodingBackfill) Sweep(interval time.Duration, options func() GeocodingBackfillOptions, quit <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !backfill.Status().Running {
+			err := backfill.Start(options())
+			if err != nil {
+				log.Printf("Unable to start geocoding sweep: %v", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+/*
+Dates can be given as just a day or as a full timestamp
+*/
+func parseBackfillDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse("2006-01-02", value)
+	if err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01-02T15:04:05", value)
+}
+
+func GeocodingBackfillStatusHandler(c *gin.Context) {
+	if geocodingBackfill == nil {
+		c.String(503, "Geocoding backfill not available")
+		return
+	}
+	c.JSON(200, geocodingBackfill.Status())
+}
+
+func GeocodingBackfillStartHandler(c *gin.Context) {
+	if geocodingBackfill == nil {
+		c.String(503, "Geocoding backfill not available")
+		return
+	}
+	options := defaultGeocodingBackfillOptions()
+	var err error
+	if rate := c.Query("rate"); rate != "" {
+		options.Rate, err = strconv.ParseFloat(rate, 64)
+		if err != nil {
+			c.String(400, "Invalid rate: %v", err)
+			return
+		}
+	}
+	if batchSize := c.Query("batch"); batchSize != "" {
+		options.BatchSize, err = strconv.Atoi(batchSize)
+		if err != nil {
+			c.String(400, "Invalid batch size: %v", err)
+			return
+		}
+	}
+	options.From, err = parseBackfillDate(c.Query("from"))
+	if err != nil {
+		c.String(400, "Invalid from date: %v", err)
+		return
+	}
+	options.To, err = parseBackfillDate(c.Query("to"))
+	if err != nil {
+		c.String(400, "Invalid to date: %v", err)
+		return
+	}
+	options.Regeocode = c.Query("regeocode")
+	err = geocodingBackfill.Start(options)
+	if err != nil {
+		c.String(409, err.Error())
+		return
+	}
+	c.JSON(202, geocodingBackfill.Status())
+}
+
+func GeocodingBackfillStopHandler(c *gin.Context) {
+	if geocodingBackfill == nil {
+		c.String(503, "Geocoding backfill not available")
+		return
+	}
+	if !geocodingBackfill.Stop() {
+		c.String(409, "Geocoding backfill is not running")
+		return
+	}
+	c.JSON(200, geocodingBackfill.Status())
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGeocodingBackfillDefaultsToUngeocodedLocations(t *testing.T) {
+	conditions, args := geocodingBackfillConditions(GeocodingBackfillOptions{}, nil)
+	assert.Equal(t, "not excluded and geocoding is null", conditions)
+	assert.Empty(t, args)
+}
+
+func TestGeocodingBackfillConditionsNumberPlaceholdersAfterExistingArgs(t *testing.T) {
+	from := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	conditions, args := geocodingBackfillConditions(GeocodingBackfillOptions{From: from, To: to, Regeocode: "nominatim"}, []interface{}{int64(10), 100})
+	assert.Equal(t, "not excluded and (geocoding is null or coalesce(geocoding ->> 'provider', 'google') != $3) and devicetimestamp >= $4 and devicetimestamp < $5", conditions)
+	assert.Equal(t, []interface{}{int64(10), 100, "nominatim", from, to}, args)
+}
+
+func TestGeocodingBackfillRecordsErrorsAndFinishes(t *testing.T) {
+	backfill := NewGeocodingBackfill(NewGeocodingQueue(1, 1, time.Millisecond, func(id int64) error { return nil }, nil), nil)
+	assert.False(t, backfill.Stop())
+	assert.Nil(t, backfill.Start(GeocodingBackfillOptions{}))
+	assert.Eventually(t, func() bool { return !backfill.Status().Running }, 5*time.Second, time.Millisecond)
+	status := backfill.Status()
+	assert.Equal(t, "No database connection available", status.LastError)
+	assert.Equal(t, 1, status.Options.BatchSize)
+	assert.False(t, status.Finished.IsZero())
+}
+
+func TestStoppedGeocodingBackfillCanBeStartedAgainStraightAway(t *testing.T) {
+	backfill := NewGeocodingBackfill(NewGeocodingQueue(1, 1, time.Millisecond, func(id int64) error { return nil }, nil), nil)
+	// As if a run were still queueing
+	backfill.generation = 1
+	backfill.status = GeocodingBackfillStatus{Running: true}
+	backfill.stop = make(chan bool)
+	stopped := backfill.stop
+	assert.True(t, backfill.Stop())
+	assert.False(t, backfill.Status().Running)
+	assert.False(t, backfill.Status().Finished.IsZero())
+	_, open := <-stopped
+	assert.False(t, open)
+	assert.False(t, backfill.Stop())
+
+	assert.Nil(t, backfill.Start(GeocodingBackfillOptions{BatchSize: 5}))
+	// Stragglers from the stopped run don't count towards the new one
+	backfill.update(1, func(status *GeocodingBackfillStatus) { status.Done++ })
+	assert.Equal(t, int64(0), backfill.Status().Done)
+	assert.Equal(t, 5, backfill.Status().Options.BatchSize)
+}
+
+func TestGeocodingSweepCoversRecentAndImportedLocations(t *testing.T) {
+	since := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	conditions, args := geocodingBackfillConditions(GeocodingBackfillOptions{InsertedSince: since}, nil)
+	assert.Equal(t, "not excluded and geocoding is null and (timestamp >= $1 or source is not null)", conditions)
+	assert.Equal(t, []interface{}{since}, args)
+
+	configuration.EnableGeocodingCrawler = false
+	assert.False(t, geocodingSweepOptions().InsertedSince.IsZero())
+	assert.Equal(t, geocodingSweepMaxFailures, geocodingSweepOptions().MaxFailures)
+	configuration.EnableGeocodingCrawler = true
+	defer func() { configuration.EnableGeocodingCrawler = false }()
+	assert.True(t, geocodingSweepOptions().InsertedSince.IsZero())
+}
+
+func TestBackfillDatesAcceptDaysAndTimestamps(t *testing.T) {
+	day, err := parseBackfillDate("2020-03-01")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), day)
+	timestamp, err := parseBackfillDate("2020-03-01T12:30:00")
+	assert.Nil(t, err)
+	assert.Equal(t, 12, timestamp.Hour())
+	_, err = parseBackfillDate("yesterday")
+	assert.NotNil(t, err)
+}
+
+func TestGeocodingSweepLeavesOutLocationsThatKeepFailing(t *testing.T) {
+	conditions, args := geocodingBackfillConditions(GeocodingBackfillOptions{MaxFailures: 3}, nil)
+	assert.Equal(t, "not excluded and geocoding is null and not exists (select 1 from geocodingfailures where locationid = locations.id and attempts >= $1)", conditions)
+	assert.Equal(t, []interface{}{3}, args)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Nearby fixes share a cache entry, so sitting still doesn't mean hitting the geocoding API for every location
+*/
+func reverseGeocodingCacheKey(latitude float64, longitude float64, precision int) string {
+	return fmt.Sprintf("reverse:%s,%s", roundCoordinate(latitude, precision), roundCoordinate(longitude, precision))
+}
+
+func roundCoordinate(coordinate float64, precision int) string {
+	multiplier := math.Pow(10, float64(precision))
+	rounded := math.Round(coordinate*multiplier) / multiplier
+	if rounded == 0 {
+		// Avoid -0 and 0 being different keys
+		rounded = 0
+	}
+	return strconv.FormatFloat(rounded, 'f', precision, 64)
+}
+
+func forwardGeocodingCacheKey(query string) string {
+	return "forward:" + strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+func getCachedGeocoding(key string) (string, bool) {
+	if db == nil || configuration.GeocodingCacheDays <= 0 {
+		return "", false
+	}
+	var response string
+	err := db.QueryRow(
+		"select response from geocodingcache where key=$1 and created > $2",
+		key,
+		time.Now().AddDate(0, 0, -configuration.GeocodingCacheDays),
+	).Scan(&response)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error reading geocoding cache: %v", err)
+		}
+		return "", false
+	}
+	return response, true
+}
+
+func putCachedGeocoding(key string, response string) {
+	if db == nil || configuration.GeocodingCacheDays <= 0 {
+		return
+	}
+	_, err := db.Exec(
+		"insert into geocodingcache (key, created, response) values ($1, $2, $3) "+
+			"on conflict (key) do update set created = excluded.created, response = excluded.response",
+		key,
+		time.Now(),
+		response,
+	)
+	if err != nil {
+		log.Printf("Error writing geocoding cache: %v", err)
+	}
+}
+
+/*
+Returns the cached response for key if there is one, otherwise fetches and caches it
+*/
+func cachedGeocoding(key string, fetch func() (string, error)) (string, error) {
+	if response, ok := getCachedGeocoding(key); ok {
+		log.Printf("Geocoding cache hit for %v", key)
+		return response, nil
+	}
+	response, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	putCachedGeocoding(key, response)
+	return response, nil
+}
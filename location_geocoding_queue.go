@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+What a job geocodes. Ids are only unique within a target
+*/
+type GeocodingTarget string
+
+const (
+	LocationTarget GeocodingTarget = "location"
+	VisitTarget    GeocodingTarget = "visit"
+)
+
+type geocodingKey struct {
+	Target GeocodingTarget
+	ID     int64
+}
+
+/*
+A specific location or visit to geocode. Backlog jobs come from the backfill and only run when there's no live work.
+Done, if set, is called once the job has either succeeded or been given up on
+*/
+type GeocodingJob struct {
+	Target   GeocodingTarget
+	ID       int64
+	Backlog  bool
+	Attempts int
+	Done     func(error)
+}
+
+func (job GeocodingJob) key() geocodingKey {
+	return geocodingKey{Target: job.Target, ID: job.ID}
+}
+
+type GeocodingQueue struct {
+	live        chan GeocodingJob
+	backlog     chan GeocodingJob
+	mutex       sync.Mutex
+	pending     map[geocodingKey]bool
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	geocoders   map[GeocodingTarget]func(int64) error
+}
+
+func NewGeocodingQueue(workers int, maxAttempts int, backoff time.Duration, geocodeLocation func(int64) error, geocodeVisit func(int64) error) *GeocodingQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &GeocodingQueue{
+		live:        make(chan GeocodingJob, 1000),
+		backlog:     make(chan GeocodingJob, 100),
+		pending:     make(map[geocodingKey]bool),
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		geocoders:   map[GeocodingTarget]func(int64) error{LocationTarget: geocodeLocation, VisitTarget: geocodeVisit},
+	}
+}
+
+/*
+Marks the job as pending. Returns false if it's already queued or being geocoded
+*/
+func (queue *GeocodingQueue) claim(key geocodingKey) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.pending[key] {
+		return false
+	}
+	queue.pending[key] = true
+	return true
+}
+
+func (queue *GeocodingQueue) release(key geocodingKey) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	delete(queue.pending, key)
+}
+
+/*
+Queue a newly arrived location. Never blocks: if the queue is full the next sweep will pick the location up
+*/
+func (queue *GeocodingQueue) Enqueue(id int64) bool {
+	return queue.enqueueLive(GeocodingJob{Target: LocationTarget, ID: id}, "the next sweep")
+}
+
+/*
+Queue a visit none of its fixes could name. Never blocks: if the queue is full the visit's next rebuild tries again
+*/
+func (queue *GeocodingQueue) EnqueueVisit(id int64) bool {
+	return queue.enqueueLive(GeocodingJob{Target: VisitTarget, ID: id}, "its next rebuild")
+}
+
+func (queue *GeocodingQueue) enqueueLive(job GeocodingJob, retry string) bool {
+	if queue == nil || !queue.claim(job.key()) {
+		return false
+	}
+	select {
+	case queue.live <- job:
+		return true
+	default:
+		log.Printf("Geocoding queue full, leaving %v id=%v for %v", job.Target, job.ID, retry)
+		queue.release(job.key())
+		return false
+	}
+}
+
+/*
+Queue a location from the backlog, waiting for space
+*/
+func (queue *GeocodingQueue) EnqueueBacklog(id int64, done func(error), quit <-chan bool) bool {
+	job := GeocodingJob{Target: LocationTarget, ID: id, Backlog: true, Done: done}
+	if queue == nil || !queue.claim(job.key()) {
+		return false
+	}
+	select {
+	case queue.backlog <- job:
+		return true
+	case <-quit:
+		queue.release(job.key())
+		return false
+	}
+}
+
+func (queue *GeocodingQueue) Run(quit <-chan bool) {
+	log.Printf("Starting %d geocoding workers", queue.workers)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < queue.workers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			queue.work(quit)
+		}()
+	}
+	waitGroup.Wait()
+	log.Print("Got signal, quitting geocoding workers.")
+}
+
+func (queue *GeocodingQueue) work(quit <-chan bool) {
+	for {
+		// Live work always goes first
+		select {
+		case job := <-queue.live:
+			queue.process(job, quit)
+			continue
+		default:
+		}
+		select {
+		case job := <-queue.live:
+			queue.process(job, quit)
+		case job := <-queue.backlog:
+			queue.process(job, quit)
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (queue *GeocodingQueue) process(job GeocodingJob, quit <-chan bool) {
+	kind := "live"
+	if job.Backlog {
+		kind = "backlog"
+	}
+	job.Attempts++
+	err := queue.geocoders[job.Target](job.ID)
+	if err == nil {
+		log.Printf("Geocoded %v %v id=%v", kind, job.Target, job.ID)
+		queue.finish(job, nil)
+		return
+	}
+	if job.Attempts >= queue.maxAttempts {
+		// Only now is it worth telling anyone
+		InternalError(fmt.Errorf("giving up geocoding %v %v id=%v after %d attempts: %w", kind, job.Target, job.ID, job.Attempts, err))
+		queue.finish(job, err)
+		return
+	}
+	delay := queue.backoff * time.Duration(1<<uint(job.Attempts-1))
+	log.Printf("Error geocoding %v %v id=%v, retrying in %v: %v", kind, job.Target, job.ID, delay, err)
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-quit:
+			queue.release(job.key())
+			return
+		}
+		destination := queue.live
+		if job.Backlog {
+			destination = queue.backlog
+		}
+		select {
+		case destination <- job:
+		case <-quit:
+			queue.release(job.key())
+		}
+	}()
+}
+
+func (queue *GeocodingQueue) finish(job GeocodingJob, err error) {
+	queue.release(job.key())
+	if job.Done != nil {
+		job.Done(err)
+	}
+}
+
+/*
+Spaces out calls to a rate limited API across every goroutine that uses it
+*/
+type rateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(requestsPerSecond float64) *rateLimiter {
+	if requestsPerSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / requestsPerSecond)}
+}
+
+func (limiter *rateLimiter) Wait() {
+	if limiter == nil || limiter.interval == 0 {
+		return
+	}
+	limiter.mutex.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	wait := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(limiter.interval)
+	limiter.mutex.Unlock()
+	time.Sleep(wait)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGeocodingQueueIgnoresLocationsAlreadyQueued(t *testing.T) {
+	queue := NewGeocodingQueue(1, 1, time.Millisecond, func(id int64) error { return nil }, nil)
+	assert.True(t, queue.Enqueue(1))
+	assert.False(t, queue.Enqueue(1))
+	assert.True(t, queue.Enqueue(2))
+	assert.False(t, queue.EnqueueBacklog(2, nil, nil))
+	assert.Equal(t, 2, len(queue.live))
+}
+
+func TestGeocodingQueueRetriesFailedLocations(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+	done := make(chan bool)
+	queue := NewGeocodingQueue(1, 5, time.Millisecond, func(id int64) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errors.New("geocoding API unavailable")
+		}
+		close(done)
+		return nil
+	}, nil)
+	quit := make(chan bool)
+	defer close(quit)
+	go queue.Run(quit)
+	queue.Enqueue(1)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Location was never geocoded")
+	}
+	mutex.Lock()
+	assert.Equal(t, 3, attempts)
+	mutex.Unlock()
+}
+
+func TestGeocodingQueueRunsLiveWorkBeforeBacklog(t *testing.T) {
+	var processed []int64
+	done := make(chan bool)
+	queue := NewGeocodingQueue(1, 1, time.Millisecond, func(id int64) error {
+		processed = append(processed, id)
+		if len(processed) == 3 {
+			close(done)
+		}
+		return nil
+	}, nil)
+	queue.EnqueueBacklog(1, nil, nil)
+	queue.EnqueueBacklog(2, nil, nil)
+	queue.Enqueue(3)
+	quit := make(chan bool)
+	defer close(quit)
+	go queue.Run(quit)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Locations were never geocoded")
+	}
+	assert.Equal(t, int64(3), processed[0])
+}
+
+func TestGeocodingQueueKeepsVisitsApartFromLocations(t *testing.T) {
+	locations := make(chan int64, 1)
+	visits := make(chan int64, 1)
+	queue := NewGeocodingQueue(1, 1, time.Millisecond, func(id int64) error {
+		locations <- id
+		return nil
+	}, func(id int64) error {
+		visits <- id
+		return nil
+	})
+	assert.True(t, queue.EnqueueVisit(7))
+	assert.False(t, queue.EnqueueVisit(7))
+	// Same id, different table
+	assert.True(t, queue.Enqueue(7))
+	quit := make(chan bool)
+	defer close(quit)
+	go queue.Run(quit)
+	for _, geocoded := range []chan int64{visits, locations} {
+		select {
+		case id := <-geocoded:
+			assert.Equal(t, int64(7), id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job was never geocoded")
+		}
+	}
+}
+
+func TestRateLimiterSpacesOutCalls(t *testing.T) {
+	limiter := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.Wait()
+	}
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+}
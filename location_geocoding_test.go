@@ -25,3 +25,17 @@ func TestGeocodingShouldDecodeAdministrativeAreaToTheRightName(t *testing.T) {
 	name := location.Name()
 	assert.Equal(t, "Unknown", name)
 }
+
+func TestNearbyLocationsShareAReverseGeocodingCacheKey(t *testing.T) {
+	assert.Equal(t, reverseGeocodingCacheKey(51.74718, -0.47343, 4), reverseGeocodingCacheKey(51.74721, -0.47339, 4))
+	assert.Equal(t, "reverse:51.7472,-0.4734", reverseGeocodingCacheKey(51.74718, -0.47343, 4))
+	assert.NotEqual(t, reverseGeocodingCacheKey(51.7471, -0.4734, 4), reverseGeocodingCacheKey(51.7475, -0.4734, 4))
+}
+
+func TestReverseGeocodingCacheKeyHasNoNegativeZero(t *testing.T) {
+	assert.Equal(t, "reverse:0.000,0.000", reverseGeocodingCacheKey(-0.0001, 0.0001, 3))
+}
+
+func TestForwardGeocodingCacheKeyIsNormalized(t *testing.T) {
+	assert.Equal(t, "forward:hemel hempstead", forwardGeocodingCacheKey("  Hemel   HEMPSTEAD "))
+}
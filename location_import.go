@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Reads locations out of an export, calling each for every one. Raw holds the original record where the format has one
+*/
+type locationParser func(reader io.Reader, each func(location *Location, raw string) error) error
+
+var importParsers = map[string]locationParser{
+	"takeout": parseTakeoutRecords,
+	"gpx":     parseGPX,
+	"rec":     parseOwntracksRec,
+}
+
+/*
+Takes the format from the file name if it isn't given
+*/
+func importFormat(format string, filename string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".json":
+			format = "takeout"
+		case ".gpx":
+			format = "gpx"
+		case ".rec":
+			format = "rec"
+		}
+	}
+	if _, ok := importParsers[format]; !ok {
+		return "", fmt.Errorf("unknown import format %q for %v, expected takeout, gpx or rec", format, filename)
+	}
+	return format, nil
+}
+
+type takeoutRecord struct {
+	LatitudeE7       int64   `json:"latitudeE7"`
+	LongitudeE7      int64   `json:"longitudeE7"`
+	Accuracy         float32 `json:"accuracy"`
+	Altitude         float32 `json:"altitude"`
+	VerticalAccuracy float32 `json:"verticalAccuracy"`
+	Velocity         float32 `json:"velocity"`
+	TimestampMs      string  `json:"timestampMs"`
+	Timestamp        string  `json:"timestamp"`
+}
+
+/*
+Google Takeout's Records.json, which can be gigabytes, so it's decoded one record at a time
+*/
+func parseTakeoutRecords(reader io.Reader, each func(*Location, string) error) error {
+	decoder := json.NewDecoder(reader)
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('{') {
+		return errors.New("Takeout records should be a JSON object")
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if key != "locations" {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if token != json.Delim('[') {
+			return errors.New("Takeout locations should be an array")
+		}
+		for decoder.More() {
+			var record takeoutRecord
+			err = decoder.Decode(&record)
+			if err != nil {
+				return err
+			}
+			location := Location{
+				Latitude:         float64(record.LatitudeE7) / 1e7,
+				Longitude:        float64(record.LongitudeE7) / 1e7,
+				Accuracy:         record.Accuracy,
+				Altitude:         record.Altitude,
+				VerticalAccuracy: record.VerticalAccuracy,
+				// Takeout has m/s, we store km/h like OwnTracks
+				Speed: record.Velocity * 3.6,
+			}
+			if record.TimestampMs != "" {
+				milliseconds, err := strconv.ParseInt(record.TimestampMs, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid timestampMs %v: %v", record.TimestampMs, err)
+				}
+				location.DeviceTimestamp = time.Unix(0, milliseconds*int64(time.Millisecond))
+			} else {
+				location.DeviceTimestamp, err = time.Parse(time.RFC3339Nano, record.Timestamp)
+				if err != nil {
+					return fmt.Errorf("invalid timestamp %v: %v", record.Timestamp, err)
+				}
+			}
+			err = each(&location, "")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type gpxPoint struct {
+	Latitude   float64 `xml:"lat,attr"`
+	Longitude  float64 `xml:"lon,attr"`
+	Elevation  float32 `xml:"ele"`
+	Time       string  `xml:"time"`
+	Extensions struct {
+		Inner []byte `xml:",innerxml"`
+	} `xml:"extensions"`
+}
+
+/*
+Track, route and way points from a GPX file. Speed is read from any extension element called speed, which is how the
+Garmin and Cluetrak extensions both do it
+*/
+func parseGPX(reader io.Reader, each func(*Location, string) error) error {
+	decoder := xml.NewDecoder(reader)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || (start.Name.Local != "trkpt" && start.Name.Local != "rtept" && start.Name.Local != "wpt") {
+			continue
+		}
+		var point gpxPoint
+		err = decoder.DecodeElement(&point, &start)
+		if err != nil {
+			return err
+		}
+		if point.Time == "" {
+			// Without a time it's not somewhere we've been
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, point.Time)
+		if err != nil {
+			return fmt.Errorf("invalid GPX time %v: %v", point.Time, err)
+		}
+		location := Location{
+			Latitude:        point.Latitude,
+			Longitude:       point.Longitude,
+			Altitude:        point.Elevation,
+			DeviceTimestamp: timestamp,
+		}
+		speed, ok := gpxExtensionSpeed(point.Extensions.Inner)
+		if ok {
+			location.Speed = float32(speed * 3.6)
+		}
+		err = each(&location, "")
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func gpxExtensionSpeed(extensions []byte) (float64, bool) {
+	decoder := xml.NewDecoder(strings.NewReader(string(extensions)))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, false
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "speed" {
+			var speed float64
+			if decoder.DecodeElement(&speed, &start) == nil {
+				return speed, true
+			}
+			return 0, false
+		}
+	}
+}
+
+/*
+OwnTracks Recorder .rec files: a timestamp, a tag and the published JSON on each line, separated by tabs
+*/
+func parseOwntracksRec(reader io.Reader, each func(*Location, string) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		payload := strings.TrimSpace(fields[2])
+		var locator MQTTMsg
+		err := json.Unmarshal([]byte(payload), &locator)
+		if err != nil {
+			return fmt.Errorf("invalid rec line %q: %v", line, err)
+		}
+		if locator.Type != "location" {
+			continue
+		}
+		locator.DeviceTimestamp = time.Unix(locator.DeviceTimestampAsInt, 0)
+		location := locator.toLocation()
+		err = each(&location, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+type ImportResult struct {
+	Read     int       `json:"read"`
+	Inserted int       `json:"inserted"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	// Set when the import stopped part way. Everything counted in Inserted is still stored
+	Error string `json:"error,omitempty"`
+	ids   []int64
+}
+
+type importRow struct {
+	location Location
+	raw      string
+}
+
+/*
+The typed columns an OwnTracks payload fills in, same as a live location gets
+*/
+var importDetailColumns = []string{"trackerid", "batterylevel", "batterystatus", "connectiontype", "doze", "trigger",
+	"ssid", "bssid", "inregions", "courseoverground", "pressure", "monitoringmode", "topic"}
+
+/*
+Only OwnTracks payloads have the details. Everything else leaves them null rather than claiming a flat battery
+*/
+func (row importRow) detailValues() []interface{} {
+	if row.raw == "" {
+		return make([]interface{}, len(importDetailColumns))
+	}
+	location := row.location
+	return []interface{}{
+		nullIfEmpty(location.TrackerId),
+		location.Battery,
+		location.BatteryStatus,
+		nullIfEmpty(location.Connection),
+		location.Doze,
+		nullIfEmpty(location.Trigger),
+		nullIfEmpty(location.SSID),
+		nullIfEmpty(location.BSSID),
+		pq.Array(location.InRegions),
+		location.CourseOverGround,
+		location.Pressure,
+		location.MonitoringMode,
+		nullIfEmpty(location.Topic),
+	}
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+/*
+Imports everything the parser finds for the device, in batches. Each batch is COPYed into a temporary table and then
+inserted, skipping anything the unique constraints say we already have
+*/
+func ImportLocations(reader io.Reader, parser locationParser, user string, device string, source string, batchSize int) (*ImportResult, error) {
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	result := &ImportResult{}
+	batch := make([]importRow, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ids, err := insertImportBatch(batch, user, device, source)
+		if err != nil {
+			return err
+		}
+		result.Inserted += len(ids)
+		result.ids = append(result.ids, ids...)
+		log.Printf("Imported %d of %d locations read so far", result.Inserted, result.Read)
+		batch = batch[:0]
+		return nil
+	}
+	err := parser(reader, func(location *Location, raw string) error {
+		result.Read++
+		if result.From.IsZero() || location.DeviceTimestamp.Before(result.From) {
+			result.From = location.DeviceTimestamp
+		}
+		if location.DeviceTimestamp.After(result.To) {
+			result.To = location.DeviceTimestamp
+		}
+		batch = append(batch, importRow{location: *location, raw: raw})
+		if len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if result.Inserted > 0 {
+		// The fixes either side of the import have new neighbours, so their verdicts can change too
+		_, exclusionErr := ExcludeOutliers(defaultExclusionOptions(), user, device, result.From.Add(-trackGap), result.To.Add(trackGap))
+		if exclusionErr != nil {
+			log.Printf("Error excluding outliers after import for %v/%v: %v", user, device, exclusionErr)
+		}
+		invalidateVisits(user, device, result.From)
+	}
+	return result, err
+}
+
+func insertImportBatch(batch []importRow, user string, device string, source string) ([]int64, error) {
+	defer timeTrack(time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("create temporary table importlocations (" +
+		"devicetimestamp timestamp with time zone, latitude double precision, longitude double precision, " +
+		"accuracy double precision, altitude double precision, verticalaccuracy double precision, speed double precision, " +
+		"raw text, trackerid text, batterylevel integer, batterystatus integer, connectiontype text, doze boolean, " +
+		"trigger text, ssid text, bssid text, inregions text[], courseoverground integer, pressure double precision, " +
+		"monitoringmode integer, topic text) on commit drop")
+	if err != nil {
+		return nil, err
+	}
+	statement, err := tx.Prepare(pq.CopyIn("importlocations", append([]string{"devicetimestamp", "latitude", "longitude",
+		"accuracy", "altitude", "verticalaccuracy", "speed", "raw"}, importDetailColumns...)...))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range batch {
+		_, err = statement.Exec(append([]interface{}{row.location.DeviceTimestamp, row.location.Latitude, row.location.Longitude,
+			row.location.Accuracy, row.location.Altitude, row.location.VerticalAccuracy, row.location.Speed, row.raw},
+			row.detailValues()...)...)
+		if err != nil {
+			statement.Close()
+			return nil, err
+		}
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		statement.Close()
+		return nil, err
+	}
+	err = statement.Close()
+	if err != nil {
+		return nil, err
+	}
+	details := strings.Join(importDetailColumns, ", ")
+	rows, err := tx.Query("insert into locations "+
+		"(timestamp, devicetimestamp, accuracy, point, altitude, verticalaccuracy, speed, username, device, raw, source, "+details+") "+
+		"select now(), devicetimestamp, accuracy, ST_SetSRID(ST_MakePoint(longitude, latitude), 4326), "+
+		"altitude, verticalaccuracy, speed, $1, $2, nullif(raw, '')::jsonb, $3, "+details+" from importlocations "+
+		"on conflict do nothing returning id", user, device, source)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+/*
+Imported history can land before visits we've already detected, so those have to be found again
+*/
+func invalidateVisits(user string, device string, from time.Time) {
+	_, err := db.Exec("delete from visits where username=$1 and device=$2 and departure >= $3", user, device, from)
+	if err != nil {
+		log.Printf("Error clearing visits after import for %v/%v: %v", user, device, err)
+		return
+	}
+	visitDetector.Touch(user, device)
+}
+
+/*
+Imported locations go on the backlog side, so this trickles them in at whatever pace geocoding manages
+*/
+func queueImportedGeocoding(ids []int64, quit <-chan bool) {
+	if GeocodingWorkQueue == nil || reverseGeocoder == nil {
+		return
+	}
+	for _, id := range ids {
+		GeocodingWorkQueue.EnqueueBacklog(id, nil, quit)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+	}
+}
+
+/*
+The import subcommand, run against the configured database: www.growse.com import -user growse -device nexus5 Records.json
+*/
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	user := flags.String("user", "", "User the locations belong to")
+	device := flags.String("device", "", "Device the locations belong to")
+	format := flags.String("format", "", "takeout, gpx or rec. Guessed from the file extension if not given")
+	source := flags.String("source", "", "What to tag the imported locations with. Defaults to the format")
+	batchSize := flags.Int("batch", configuration.ImportBatchSize, "Locations per batch")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *user == "" || *device == "" || flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: import -user <user> -device <device> [-format takeout|gpx|rec] [-source s] [-batch n] <file>...")
+		return 2
+	}
+	if db == nil {
+		log.Print("No database host specified, unable to import")
+		return 1
+	}
+	for _, filename := range flags.Args() {
+		fileFormat, err := importFormat(*format, filename)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			log.Printf("Unable to open %v: %v", filename, err)
+			return 1
+		}
+		result, err := ImportLocations(bufio.NewReader(file), importParsers[fileFormat], *user, *device, firstNonEmpty(*source, fileFormat), *batchSize)
+		file.Close()
+		if err != nil {
+			if result != nil {
+				log.Printf("Error importing %v after storing %d new locations: %v", filename, result.Inserted, err)
+			} else {
+				log.Printf("Error importing %v: %v", filename, err)
+			}
+			return 1
+		}
+		// There's no geocoding queue running here to hand them to
+		log.Printf("Imported %d new locations out of %d from %v. They'll be geocoded by the server's sweep if it's on, "+
+			"otherwise start a backfill through the admin API.", result.Inserted, result.Read, filename)
+	}
+	return 0
+}
+
+func ImportHandler(c *gin.Context) {
+	user := c.PostForm("user")
+	device := c.PostForm("device")
+	if user == "" || device == "" {
+		c.String(400, "user and device are required")
+		return
+	}
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.String(400, fmt.Sprintf("file is required: %v", err))
+		return
+	}
+	format, err := importFormat(c.PostForm("format"), fileHeader.Filename)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	defer file.Close()
+	source := firstNonEmpty(c.PostForm("source"), format)
+	result, err := ImportLocations(bufio.NewReader(file), importParsers[format], user, device, source, configuration.ImportBatchSize)
+	if result == nil {
+		InternalError(err)
+		c.String(500, err.Error())
+		return
+	}
+	// Batches before a failure are committed, so they still need geocoding and the client needs to know about them
+	go queueImportedGeocoding(result.ids, serverQuit)
+	if err != nil {
+		InternalError(err)
+		result.Error = err.Error()
+		c.JSON(500, result)
+		return
+	}
+	c.JSON(200, result)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func collectImport(t *testing.T, parser locationParser, input string) ([]Location, []string) {
+	var locations []Location
+	var raws []string
+	err := parser(strings.NewReader(input), func(location *Location, raw string) error {
+		locations = append(locations, *location)
+		raws = append(raws, raw)
+		return nil
+	})
+	assert.Nil(t, err)
+	return locations, raws
+}
+
+func TestImportFormatFallsBackToExtension(t *testing.T) {
+	format, err := importFormat("", "Takeout/Location History/Records.json")
+	assert.Nil(t, err)
+	assert.Equal(t, "takeout", format)
+	format, err = importFormat("gpx", "track.xml")
+	assert.Nil(t, err)
+	assert.Equal(t, "gpx", format)
+	format, err = importFormat("", "2020-06.rec")
+	assert.Nil(t, err)
+	assert.Equal(t, "rec", format)
+	_, err = importFormat("", "track.csv")
+	assert.NotNil(t, err)
+}
+
+func TestParseTakeoutRecords(t *testing.T) {
+	input := `{"locations": [
+		{"timestampMs": "1591002000000", "latitudeE7": 517472000, "longitudeE7": -4734000, "accuracy": 20, "velocity": 10, "altitude": 120, "activity": [{"type": "STILL"}]},
+		{"timestamp": "2020-06-01T09:01:00.500Z", "latitudeE7": 517480000, "longitudeE7": -4700000, "accuracy": 15}
+	], "other": {"ignored": true}}`
+	locations, _ := collectImport(t, parseTakeoutRecords, input)
+	assert.Len(t, locations, 2)
+	assert.InDelta(t, 51.7472, locations[0].Latitude, 0.0000001)
+	assert.InDelta(t, -0.4734, locations[0].Longitude, 0.0000001)
+	assert.Equal(t, float32(20), locations[0].Accuracy)
+	assert.Equal(t, float32(120), locations[0].Altitude)
+	assert.InDelta(t, 36, locations[0].Speed, 0.001)
+	assert.True(t, locations[0].DeviceTimestamp.Equal(time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)))
+	assert.True(t, locations[1].DeviceTimestamp.Equal(time.Date(2020, 6, 1, 9, 1, 0, 500000000, time.UTC)))
+}
+
+func TestParseGPXReadsTrackPointsWithSpeed(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1" xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v2">
+  <wpt lat="51.0" lon="0.0"><name>No time, skipped</name></wpt>
+  <trk><trkseg>
+    <trkpt lat="51.7472" lon="-0.4734"><ele>120.5</ele><time>2020-06-01T09:00:00Z</time>
+      <extensions><gpxtpx:TrackPointExtension><gpxtpx:speed>10</gpxtpx:speed></gpxtpx:TrackPointExtension></extensions>
+    </trkpt>
+    <trkpt lat="51.7480" lon="-0.4700"><time>2020-06-01T09:01:00Z</time></trkpt>
+  </trkseg></trk>
+</gpx>`
+	locations, _ := collectImport(t, parseGPX, input)
+	assert.Len(t, locations, 2)
+	assert.Equal(t, 51.7472, locations[0].Latitude)
+	assert.Equal(t, -0.4734, locations[0].Longitude)
+	assert.Equal(t, float32(120.5), locations[0].Altitude)
+	assert.InDelta(t, 36, locations[0].Speed, 0.001)
+	assert.Equal(t, float32(0), locations[1].Speed)
+	assert.True(t, locations[1].DeviceTimestamp.Equal(time.Date(2020, 6, 1, 9, 1, 0, 0, time.UTC)))
+}
+
+func TestParseOwntracksRecKeepsOnlyLocations(t *testing.T) {
+	input := "2020-06-01T09:00:00Z\t*                 \t{\"_type\":\"location\",\"tid\":\"n5\",\"acc\":10,\"lat\":51.7472,\"lon\":-0.4734,\"tst\":1591002000,\"batt\":80}\n" +
+		"2020-06-01T09:00:05Z\tlwt               \t{\"_type\":\"lwt\",\"tst\":1591002005}\n" +
+		"\n"
+	locations, raws := collectImport(t, parseOwntracksRec, input)
+	assert.Len(t, locations, 1)
+	assert.Equal(t, 51.7472, locations[0].Latitude)
+	assert.Equal(t, "n5", locations[0].TrackerId)
+	assert.Equal(t, 80, locations[0].Battery)
+	assert.True(t, locations[0].DeviceTimestamp.Equal(time.Unix(1591002000, 0)))
+	assert.Contains(t, raws[0], "\"tid\":\"n5\"")
+}
+
+func TestOwntracksImportsKeepTheirDetails(t *testing.T) {
+	input := "2020-06-01T09:00:00Z\t*                 \t{\"_type\":\"location\",\"tid\":\"n5\",\"acc\":10,\"lat\":51.7472,\"lon\":-0.4734,\"tst\":1591002000,\"batt\":80,\"conn\":\"w\",\"doze\":true}\n"
+	locations, raws := collectImport(t, parseOwntracksRec, input)
+	values := importRow{location: locations[0], raw: raws[0]}.detailValues()
+	assert.Len(t, values, len(importDetailColumns))
+	assert.Equal(t, "n5", values[0])
+	assert.Equal(t, 80, values[1])
+	assert.Equal(t, "w", values[3])
+	assert.Equal(t, true, values[4])
+	assert.Nil(t, values[5])
+
+	// Nothing but a position in a GPX or Takeout file
+	for _, value := range (importRow{location: Location{TrackerId: "n5"}}).detailValues() {
+		assert.Nil(t, value)
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/lib/pq"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -21,30 +25,79 @@ type MQTTMsg struct {
 	Speed                float32            `json:"vel"`
 	Altitude             float32            `json:"alt"`
 	DeviceTimestampAsInt int64              `json:"tst" binding:"required"`
+	Trigger              string             `json:"t"`
+	BatteryStatus        int                `json:"bs"`
+	SSID                 string             `json:"SSID"`
+	BSSID                string             `json:"BSSID"`
+	InRegions            []string           `json:"inregions"`
+	CourseOverGround     int                `json:"cog"`
+	Pressure             float64            `json:"p"`
+	MonitoringMode       int                `json:"m"`
+	Topic                string             `json:"topic"`
 	DeviceTimestamp      time.Time
+	User                 string          `json:"-"`
+	Device               string          `json:"-"`
+	Raw                  json.RawMessage `json:"-"`
 }
 
-var topic = "owntracks/growse/nexus5"
+func (locator MQTTMsg) toLocation() Location {
+	return Location{
+		Latitude:         locator.Latitude,
+		Longitude:        locator.Longitude,
+		DeviceTimestamp:  locator.DeviceTimestamp,
+		Accuracy:         locator.Accuracy,
+		Altitude:         locator.Altitude,
+		VerticalAccuracy: locator.VerticalAccuracy,
+		Speed:            locator.Speed,
+		User:             locator.User,
+		Device:           locator.Device,
+		TrackerId:        locator.TrackerId,
+		Battery:          locator.Battery,
+		BatteryStatus:    locator.BatteryStatus,
+		Connection:       locator.Connection,
+		Trigger:          locator.Trigger,
+		SSID:             locator.SSID,
+		BSSID:            locator.BSSID,
+		InRegions:        locator.InRegions,
+		CourseOverGround: locator.CourseOverGround,
+		Pressure:         locator.Pressure,
+		MonitoringMode:   locator.MonitoringMode,
+		Topic:            locator.Topic,
+		Doze:             bool(locator.Doze),
+	}
+}
+
+/*
+OwnTracks publishes to owntracks/<user>/<device>, optionally with a suffix (e.g. /event)
+*/
+func parseOwntracksTopic(topic string) (string, string, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("unable to find user and device in topic %v", topic)
+	}
+	return parts[1], parts[2], nil
+}
+
+/*
+Transitions, waypoints and the like come in on subtopics of the device's topic, which owntracks/+/+ doesn't match
+*/
+func topicReachesSubtopics(topic string) bool {
+	return strings.HasSuffix(topic, "#")
+}
 
 func SubscribeMQTT(quit <-chan bool) error {
 	log.Print("Connecting to MQTT")
-	var mqttClientOptions = mqtt.NewClientOptions()
-	if configuration.MQTTURL != "" {
-		mqttClientOptions.AddBroker(configuration.MQTTURL)
-	} else {
-		mqttClientOptions.AddBroker("tcp://localhost:1883")
-	}
-	if configuration.MQTTUsername != "" && configuration.MQTTPassword != "" {
-		log.Printf("Authenticating to MQTT as %v", configuration.MQTTUsername)
-		mqttClientOptions.SetUsername(configuration.MQTTUsername)
-		mqttClientOptions.SetPassword(configuration.MQTTPassword)
-	} else {
-		log.Print("Anon MQTT auth")
+	mqttClientOptions, err := buildMQTTClientOptions(configuration)
+	if err != nil {
+		log.Printf("Invalid MQTT configuration: %v", err)
+		return err
 	}
-	mqttClientOptions.SetClientID("growselocator")
-	mqttClientOptions.SetAutoReconnect(true)
+	messageHandler := mqttMessageHandler(quit)
 	mqttClientOptions.SetConnectionLostHandler(connectionLostHandler)
-	mqttClientOptions.SetOnConnectHandler(onConnectHandler)
+	mqttClientOptions.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Print("MQTT Connected!")
+		subscribeToMQTT(client, configuration.MQTTTopic, messageHandler)
+	})
 	mqttClient := mqtt.NewClient(mqttClientOptions)
 
 	mqttClientToken := mqttClient.Connect()
@@ -56,25 +109,70 @@ func SubscribeMQTT(quit <-chan bool) error {
 	}
 	log.Print("MQTT Connected")
 
-	err := subscribeToMQTT(mqttClient, topic, handler)
+	err = subscribeToMQTT(mqttClient, configuration.MQTTTopic, messageHandler)
 	if err != nil {
 		return err
 	}
 
 	select {
 	case <-quit:
-		log.Print("MQTT Unsubscribing")
-		mqttUnsubscribeToken := mqttClient.Unsubscribe(topic)
-		if mqttUnsubscribeToken.Wait() && mqttUnsubscribeToken.Error() != nil {
-			log.Printf("Error unsubscribing from mqtt: %v", mqttUnsubscribeToken.Error())
+		// A persistent session keeps its subscription on the broker, which queues whatever's published while we're
+		// restarting. Unsubscribing would throw that away
+		if configuration.MQTTCleanSession {
+			log.Print("MQTT Unsubscribing")
+			mqttUnsubscribeToken := mqttClient.Unsubscribe(configuration.MQTTTopic)
+			if mqttUnsubscribeToken.Wait() && mqttUnsubscribeToken.Error() != nil {
+				log.Printf("Error unsubscribing from mqtt: %v", mqttUnsubscribeToken.Error())
+			}
 		}
 		log.Print("Closing MQTT")
 		return nil
 	}
 }
+func buildMQTTClientOptions(configuration Configuration) (*mqtt.ClientOptions, error) {
+	if configuration.MQTTQoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d", configuration.MQTTQoS)
+	}
+	var mqttClientOptions = mqtt.NewClientOptions()
+	if configuration.MQTTURL != "" {
+		mqttClientOptions.AddBroker(configuration.MQTTURL)
+	} else {
+		mqttClientOptions.AddBroker("tcp://localhost:1883")
+	}
+	if configuration.MQTTUsername != "" && configuration.MQTTPassword != "" {
+		log.Printf("Authenticating to MQTT as %v", configuration.MQTTUsername)
+		mqttClientOptions.SetUsername(configuration.MQTTUsername)
+		mqttClientOptions.SetPassword(configuration.MQTTPassword)
+	} else {
+		log.Print("Anon MQTT auth")
+	}
+	tlsConfig, err := buildMQTTTLSConfig(configuration)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		mqttClientOptions.SetTLSConfig(tlsConfig)
+	}
+	mqttClientOptions.SetClientID(configuration.MQTTClientID)
+	mqttClientOptions.SetCleanSession(configuration.MQTTCleanSession)
+	// Keeps each device's fixes in order for the speed filter. It also means handlers mustn't block, as they hold up
+	// every other message and the keepalives
+	mqttClientOptions.SetOrderMatters(true)
+	mqttClientOptions.SetResumeSubs(!configuration.MQTTCleanSession)
+	if configuration.MQTTStoreDir != "" {
+		log.Printf("Using MQTT file store in %v", configuration.MQTTStoreDir)
+		mqttClientOptions.SetStore(mqtt.NewFileStore(configuration.MQTTStoreDir))
+	}
+	mqttClientOptions.SetAutoReconnect(true)
+	return mqttClientOptions, nil
+}
+
 func subscribeToMQTT(mqttClient mqtt.Client, topic string, handler mqtt.MessageHandler) error {
-	log.Printf("MQTT Subscribing to %v", topic)
-	mqttSubscribeToken := mqttClient.Subscribe(topic, 0, handler)
+	log.Printf("MQTT Subscribing to %v at QoS %d", topic, configuration.MQTTQoS)
+	if !topicReachesSubtopics(topic) {
+		log.Printf("MQTT topic %v doesn't end in #, so only locations will be stored and not transitions, waypoints or cards", topic)
+	}
+	mqttSubscribeToken := mqttClient.Subscribe(topic, configuration.MQTTQoS, handler)
 	if mqttSubscribeToken.Wait() && mqttSubscribeToken.Error() != nil {
 		log.Printf("Error connecting to mqtt: %v", mqttSubscribeToken.Error())
 		mqttClient.Disconnect(250)
@@ -84,43 +182,227 @@ func subscribeToMQTT(mqttClient mqtt.Client, topic string, handler mqtt.MessageH
 	return nil
 }
 
-var onConnectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	log.Print("MQTT Connected!")
-	subscribeToMQTT(client, topic, handler)
-}
-
 var connectionLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
 	log.Printf("MQTT Connection lost: %v", err)
 }
 
-var handler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("Received mqtt message from %v", msg.Topic())
-	var locator MQTTMsg
-	err := json.Unmarshal(msg.Payload(), &locator)
+const (
+	mqttStoreRetryMin = time.Second
+	mqttStoreRetryMax = time.Minute
+)
+
+/*
+Returning from the handler acks the message, by which point a location is in the database or the retry queue. If it
+couldn't go in either, it's retried away from the handler so the rest of the messages keep flowing
+*/
+func mqttMessageHandler(quit <-chan bool) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		log.Printf("Received mqtt message from %v", msg.Topic())
+		user, device, err := parseOwntracksTopic(msg.Topic())
+		if err != nil {
+			log.Printf("Error decoding MQTT topic: %v", err)
+			return
+		}
+		err = handleOwntracksMessage(user, device, msg.Payload())
+		if errors.Is(err, errLocationNotStored) {
+			go retryUnstoredMessage(user, device, msg.Payload(), quit)
+			return
+		}
+		if err != nil {
+			log.Printf("Error handling MQTT message: %v", err)
+			log.Print(msg.Payload())
+		}
+	}
+}
 
+/*
+Keeps trying to get a location into the database or the retry queue, backing off as it goes. Has one last go on the
+way out, as this is the only copy left
+*/
+func retryUnstoredMessage(user string, device string, payload []byte, quit <-chan bool) {
+	wait := mqttStoreRetryMin
+	for {
+		log.Printf("Retrying MQTT message from %v/%v in %v", user, device, wait)
+		select {
+		case <-quit:
+			err := handleOwntracksMessage(user, device, payload)
+			if err != nil {
+				InternalError(fmt.Errorf("lost MQTT message from %v/%v when quitting: %w", user, device, err))
+			}
+			return
+		case <-time.After(wait):
+		}
+		err := handleOwntracksMessage(user, device, payload)
+		if !errors.Is(err, errLocationNotStored) {
+			if err != nil {
+				log.Printf("Error handling MQTT message: %v", err)
+			}
+			return
+		}
+		wait *= 2
+		if wait > mqttStoreRetryMax {
+			wait = mqttStoreRetryMax
+		}
+	}
+}
+
+/*
+A location that's neither in the database nor the retry queue, so whoever sent it needs to send it again
+*/
+var errLocationNotStored = errors.New("location not stored")
+
+/*
+Decode and store an OwnTracks payload according to its _type
+*/
+func handleOwntracksMessage(user string, device string, payload []byte) error {
+	var envelope struct {
+		Type string `json:"_type"`
+	}
+	err := json.Unmarshal(payload, &envelope)
 	if err != nil {
-		log.Printf("Error decoding MQTT message: %v", err)
-		log.Print(msg.Payload())
-		return
+		return err
 	}
-	if locator.Type != "location" {
-		log.Printf("Received message is of type %v. Skipping", locator.Type)
-		return
+	switch envelope.Type {
+	case "location":
+		var locator MQTTMsg
+		err = json.Unmarshal(payload, &locator)
+		if err != nil {
+			return err
+		}
+		locator.User = user
+		locator.Device = device
+		locator.Raw = payload
+		if locator.Topic == "" {
+			locator.Topic = fmt.Sprintf("owntracks/%s/%s", user, device)
+		}
+		locator.DeviceTimestamp = time.Unix(locator.DeviceTimestampAsInt, 0)
+		result, err := insertLocationToDatabase(locator)
+		if result == InsertResultFailed {
+			if locationRetryQueue == nil {
+				InternalError(err)
+				return fmt.Errorf("%w: %v", errLocationNotStored, err)
+			}
+			log.Printf("Queueing location for retry: %v", err)
+			queueErr := locationRetryQueue.Enqueue(locator)
+			if queueErr != nil {
+				return fmt.Errorf("%w: %v", errLocationNotStored, queueErr)
+			}
+			return nil
+		}
+		return err
+	case "transition":
+		var transition MQTTTransition
+		err = json.Unmarshal(payload, &transition)
+		if err != nil {
+			return err
+		}
+		transition.User = user
+		transition.Device = device
+		return insertTransitionToDatabase(transition)
+	case "waypoint":
+		var waypoint MQTTWaypoint
+		err = json.Unmarshal(payload, &waypoint)
+		if err != nil {
+			return err
+		}
+		return insertWaypointsToDatabase(user, device, []MQTTWaypoint{waypoint})
+	case "waypoints":
+		var waypoints MQTTWaypoints
+		err = json.Unmarshal(payload, &waypoints)
+		if err != nil {
+			return err
+		}
+		return insertWaypointsToDatabase(user, device, waypoints.Waypoints)
+	case "lwt":
+		var lwt MQTTLWT
+		err = json.Unmarshal(payload, &lwt)
+		if err != nil {
+			return err
+		}
+		return insertLWTToDatabase(user, device, lwt)
+	case "card":
+		var card MQTTCard
+		err = json.Unmarshal(payload, &card)
+		if err != nil {
+			return err
+		}
+		card.User = user
+		card.Device = device
+		return insertCardToDatabase(card)
+	default:
+		log.Printf("Received message is of type %v. Skipping", envelope.Type)
 	}
+	return nil
+}
+
+/*
+What happened when we tried to store a location
+*/
+type InsertResult int
+
+const (
+	InsertResultInserted InsertResult = iota
+	InsertResultDuplicate
+	InsertResultRejected
+	InsertResultFailed
+)
+
+func (result InsertResult) String() string {
+	switch result {
+	case InsertResultInserted:
+		return "inserted"
+	case InsertResultDuplicate:
+		return "duplicate"
+	case InsertResultRejected:
+		return "rejected"
+	case InsertResultFailed:
+		return "failed"
+	}
+	return "unknown"
+}
 
-	locator.DeviceTimestamp = time.Unix(locator.DeviceTimestampAsInt, 0)
+var locationInsertResults = expvar.NewMap("locationInsertResults")
 
-	insertLocationToDatabase(locator)
+/*
+Duplicates are the phone resending a fix we already have. Bad data is rejected, and anything else is assumed to be the
+database being unavailable, which is worth retrying
+*/
+func classifyInsertError(err error) InsertResult {
+	if err == nil {
+		return InsertResultInserted
+	}
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return InsertResultFailed
+	}
+	if pqErr.Code == "23505" {
+		return InsertResultDuplicate
+	}
+	switch pqErr.Code.Class() {
+	case "08", "40", "53", "57", "58":
+		return InsertResultFailed
+	}
+	return InsertResultRejected
 }
 
-func insertLocationToDatabase(locator MQTTMsg) {
+func insertLocationToDatabase(locator MQTTMsg) (InsertResult, error) {
 	defer timeTrack(time.Now())
-	newLocation := false
+	if db == nil {
+		return InsertResultFailed, errors.New("No database connection available")
+	}
 	dozebool := bool(locator.Doze)
-	_, err := db.Exec(
+	excludedReason := ""
+	if accuracyExcluded(locator.Accuracy, defaultExclusionOptions()) {
+		excludedReason = exclusionAccuracy
+	}
+	var id int64
+	err := db.QueryRow(
 		"insert into locations "+
-			"(timestamp,devicetimestamp,accuracy,doze,batterylevel,connectiontype,point, altitude, verticalaccuracy, speed) "+
-			"values ($1,$2,$3,$4,$5,$6, ST_SetSRID(ST_MakePoint($7, $8), 4326), $9, $10, $11)",
+			"(timestamp,devicetimestamp,accuracy,doze,batterylevel,connectiontype,point, altitude, verticalaccuracy, speed, username, device, trackerid, "+
+			"raw, trigger, batterystatus, ssid, bssid, inregions, courseoverground, pressure, monitoringmode, topic, excluded, excludedreason) "+
+			"values ($1,$2,$3,$4,$5,$6, ST_SetSRID(ST_MakePoint($7, $8), 4326), $9, $10, $11, $12, $13, $14, "+
+			"nullif($15, '')::jsonb, nullif($16, ''), $17, nullif($18, ''), nullif($19, ''), $20, $21, $22, $23, $24, $25 != '', nullif($25, '')) "+
+			"returning id",
 
 		time.Now(),
 		locator.DeviceTimestamp,
@@ -133,21 +415,48 @@ func insertLocationToDatabase(locator MQTTMsg) {
 		locator.Altitude,
 		locator.VerticalAccuracy,
 		locator.Speed,
-	)
-
-	switch i := err.(type) {
-	case nil:
-		newLocation = true
-		break
-	case *pq.Error:
-		log.Printf("Pg error: %v", err)
+		locator.User,
+		locator.Device,
+		locator.TrackerId,
+		string(locator.Raw),
+		locator.Trigger,
+		locator.BatteryStatus,
+		locator.SSID,
+		locator.BSSID,
+		pq.Array(locator.InRegions),
+		locator.CourseOverGround,
+		locator.Pressure,
+		locator.MonitoringMode,
+		locator.Topic,
+		excludedReason,
+	).Scan(&id)
+
+	result := classifyInsertError(err)
+	locationInsertResults.Add(result.String(), 1)
+	switch result {
+	case InsertResultInserted:
+		if excludedReason == "" && excludeAroundNewFix(id, locator.User, locator.Device, locator.DeviceTimestamp) {
+			excludedReason = exclusionSpeed
+		}
+		if excludedReason != "" {
+			// Kept, but it's not going on the map or anywhere else
+			log.Printf("Location for %v/%v at %v excluded on %v", locator.User, locator.Device, locator.DeviceTimestamp, excludedReason)
+			return result, nil
+		}
+		locationHub.Publish(locator.toLocation().toOT())
+		if reverseGeocoder != nil {
+			GeocodingWorkQueue.Enqueue(id)
+		}
+		visitDetector.Touch(locator.User, locator.Device)
+		return result, nil
+	case InsertResultDuplicate:
+		log.Printf("Location for %v/%v at %v already stored", locator.User, locator.Device, locator.DeviceTimestamp)
+		return result, nil
+	case InsertResultRejected:
+		log.Printf("Location rejected by database: %v", err)
 		log.Printf("Locator struct: %v", locator)
 	default:
 		log.Printf("%T %v", err, err)
-		InternalError(i)
-		return
-	}
-	if newLocation {
-		GeocodingWorkQueue <- true
 	}
+	return result, err
 }
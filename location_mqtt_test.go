@@ -2,7 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestMQTTMarshallWorks(t *testing.T) {
@@ -28,3 +35,140 @@ func TestMQTTMarshallWorks(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestOwntracksTopicIsParsedIntoUserAndDevice(t *testing.T) {
+	user, device, err := parseOwntracksTopic("owntracks/growse/nexus5")
+	assert.Nil(t, err)
+	assert.Equal(t, "growse", user)
+	assert.Equal(t, "nexus5", device)
+}
+
+func TestOwntracksTopicWithSuffixIsParsedIntoUserAndDevice(t *testing.T) {
+	user, device, err := parseOwntracksTopic("owntracks/growse/nexus5/event")
+	assert.Nil(t, err)
+	assert.Equal(t, "growse", user)
+	assert.Equal(t, "nexus5", device)
+}
+
+func TestOwntracksTopicWithoutDeviceIsAnError(t *testing.T) {
+	_, _, err := parseOwntracksTopic("owntracks/growse")
+	assert.NotNil(t, err)
+}
+
+func TestOnlyWildcardTopicsReachEventSubtopics(t *testing.T) {
+	assert.True(t, topicReachesSubtopics("owntracks/#"))
+	assert.True(t, topicReachesSubtopics("owntracks/growse/#"))
+	assert.False(t, topicReachesSubtopics("owntracks/+/+"))
+}
+
+func TestMQTTMarshallKeepsTheFullPayload(t *testing.T) {
+	testMsg := "{\"_type\":\"location\",\"tid\":\"s5\",\"acc\":20,\"batt\":90,\"bs\":2,\"conn\":\"w\",\"SSID\":\"home\",\"BSSID\":\"aa:bb:cc:dd:ee:ff\",\"inregions\":[\"Home\"],\"cog\":270,\"p\":101.325,\"m\":1,\"lat\":51.7471862,\"lon\":-0.4734345,\"t\":\"u\",\"tst\":1483358150}"
+
+	var locator MQTTMsg
+	err := json.Unmarshal([]byte(testMsg), &locator)
+	assert.Nil(t, err)
+	position := locator.toLocation().toOT()
+	assert.Equal(t, "u", position.T)
+	assert.Equal(t, 2, position.Bs)
+	assert.Equal(t, 90, position.Batt)
+	assert.Equal(t, "w", position.Conn)
+	assert.Equal(t, "home", position.SSID)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", position.BSSID)
+	assert.Equal(t, []string{"Home"}, position.InRegions)
+	assert.Equal(t, 270, position.Cog)
+	assert.Equal(t, 101.325, position.P)
+	assert.Equal(t, 1, position.M)
+}
+
+func TestInsertErrorsAreClassified(t *testing.T) {
+	assert.Equal(t, InsertResultInserted, classifyInsertError(nil))
+	assert.Equal(t, InsertResultDuplicate, classifyInsertError(&pq.Error{Code: "23505"}))
+	assert.Equal(t, InsertResultRejected, classifyInsertError(&pq.Error{Code: "22003"}))
+	assert.Equal(t, InsertResultFailed, classifyInsertError(&pq.Error{Code: "57P01"}))
+	assert.Equal(t, InsertResultFailed, classifyInsertError(&pq.Error{Code: "08006"}))
+	assert.Equal(t, InsertResultFailed, classifyInsertError(errors.New("dial tcp: connection refused")))
+}
+
+func TestMQTTClientOptionsForAPersistentSession(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "mqttstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storeDir)
+	options, err := buildMQTTClientOptions(Configuration{
+		MQTTURL:          "tcp://broker:1883",
+		MQTTClientID:     "growselocator",
+		MQTTQoS:          1,
+		MQTTCleanSession: false,
+		MQTTStoreDir:     storeDir,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "growselocator", options.ClientID)
+	assert.False(t, options.CleanSession)
+	assert.True(t, options.ResumeSubs)
+	assert.True(t, options.Order)
+	assert.True(t, options.AutoReconnect)
+	assert.Equal(t, "tcp://broker:1883", options.Servers[0].String())
+	assert.IsType(t, &mqtt.FileStore{}, options.Store)
+}
+
+func TestMQTTClientOptionsForACleanSession(t *testing.T) {
+	options, err := buildMQTTClientOptions(Configuration{MQTTClientID: "growselocator", MQTTCleanSession: true})
+	assert.Nil(t, err)
+	assert.True(t, options.CleanSession)
+	assert.False(t, options.ResumeSubs)
+	assert.True(t, options.Order)
+	assert.Equal(t, "tcp://localhost:1883", options.Servers[0].String())
+	// paho falls back to an in memory store
+	assert.Nil(t, options.Store)
+}
+
+func TestMQTTClientOptionsRejectAnInvalidQoS(t *testing.T) {
+	_, err := buildMQTTClientOptions(Configuration{MQTTQoS: 3})
+	assert.NotNil(t, err)
+}
+
+type testMQTTMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (msg testMQTTMessage) Duplicate() bool   { return false }
+func (msg testMQTTMessage) Qos() byte         { return 1 }
+func (msg testMQTTMessage) Retained() bool    { return false }
+func (msg testMQTTMessage) Topic() string     { return msg.topic }
+func (msg testMQTTMessage) MessageID() uint16 { return 1 }
+func (msg testMQTTMessage) Payload() []byte   { return msg.payload }
+func (msg testMQTTMessage) Ack()              {}
+
+func TestUnstoredLocationDoesNotHoldUpTheHandler(t *testing.T) {
+	payload := []byte(`{"_type":"location","lat":51.7,"lon":-0.4,"tst":1483358150}`)
+	err := handleOwntracksMessage("growse", "nexus5", payload)
+	assert.True(t, errors.Is(err, errLocationNotStored))
+
+	quit := make(chan bool)
+	defer close(quit)
+	returned := make(chan bool)
+	go func() {
+		mqttMessageHandler(quit)(nil, testMQTTMessage{topic: "owntracks/growse/nexus5", payload: payload})
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Handler blocked the rest of the messages")
+	}
+}
+
+func TestUnstoredLocationGoesToTheRetryQueueWhenQuitting(t *testing.T) {
+	directory, err := ioutil.TempDir("", "retryqueue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	quit := make(chan bool)
+	close(quit)
+	locationRetryQueue, err = NewLocationRetryQueue(directory)
+	assert.Nil(t, err)
+	defer func() { locationRetryQueue = nil }()
+	retryUnstoredMessage("growse", "nexus5", []byte(`{"_type":"location","lat":51.7,"lon":-0.4,"tst":1483358150}`), quit)
+	pending, err := locationRetryQueue.Pending()
+	assert.Nil(t, err)
+	assert.Len(t, pending, 1)
+}
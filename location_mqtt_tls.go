@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+)
+
+/*
+Builds the TLS config for the broker connection. Returns nil for a plain tcp:// or ws:// broker with no TLS material
+configured
+*/
+func buildMQTTTLSConfig(configuration Configuration) (*tls.Config, error) {
+	secureScheme := false
+	if configuration.MQTTURL != "" {
+		brokerURL, err := url.Parse(configuration.MQTTURL)
+		if err != nil {
+			return nil, err
+		}
+		switch brokerURL.Scheme {
+		case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+			secureScheme = true
+		}
+	}
+	if !secureScheme && configuration.MQTTCACertFile == "" && configuration.MQTTClientCertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         configuration.MQTTTLSServerName,
+		InsecureSkipVerify: configuration.MQTTTLSInsecure,
+	}
+	if configuration.MQTTTLSInsecure {
+		log.Print("MQTT broker certificate verification is disabled")
+	}
+
+	if configuration.MQTTCACertFile != "" {
+		caBytes, err := ioutil.ReadFile(configuration.MQTTCACertFile)
+		if err != nil {
+			return nil, err
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates found in %v", configuration.MQTTCACertFile)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	if configuration.MQTTClientCertFile != "" || configuration.MQTTClientKeyFile != "" {
+		if configuration.MQTTClientCertFile == "" || configuration.MQTTClientKeyFile == "" {
+			return nil, errors.New("MQTT client certificate and key must both be set")
+		}
+		clientCertificate, err := tls.LoadX509KeyPair(configuration.MQTTClientCertFile, configuration.MQTTClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCertificate}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+func newTestCertificate(t *testing.T, commonName string, isCA bool, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		template.DNSNames = []string{"localhost"}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+/*
+Just enough of a broker to accept a TLS connection and CONNACK it
+*/
+func startTLSBrokerStandIn(t *testing.T, ca *testCertificate, server *testCertificate) net.Listener {
+	serverCertificate, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	assert.Nil(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.certificate)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					packet, err := packets.ReadPacket(conn)
+					if err != nil {
+						return
+					}
+					switch packet.(type) {
+					case *packets.ConnectPacket:
+						packets.NewControlPacket(packets.Connack).Write(conn)
+					case *packets.PingreqPacket:
+						packets.NewControlPacket(packets.Pingresp).Write(conn)
+					case *packets.DisconnectPacket:
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, content, 0600))
+	return path
+}
+
+func TestMQTTClientConnectsToTLSBrokerWithClientCertificate(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "mqtttls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	ca := newTestCertificate(t, "test ca", true, nil)
+	server := newTestCertificate(t, "localhost", false, ca)
+	client := newTestCertificate(t, "growselocator", false, ca)
+	listener := startTLSBrokerStandIn(t, ca, server)
+	defer listener.Close()
+
+	testConfiguration := Configuration{
+		MQTTURL:            fmt.Sprintf("ssl://%v", listener.Addr().String()),
+		MQTTClientID:       "growselocator",
+		MQTTQoS:            1,
+		MQTTCACertFile:     writeTestFile(t, tempDir, "ca.pem", ca.certPEM),
+		MQTTClientCertFile: writeTestFile(t, tempDir, "client.pem", client.certPEM),
+		MQTTClientKeyFile:  writeTestFile(t, tempDir, "client.key", client.keyPEM),
+	}
+	options, err := buildMQTTClientOptions(testConfiguration)
+	assert.Nil(t, err)
+	options.SetAutoReconnect(false)
+	options.SetConnectTimeout(5 * time.Second)
+
+	mqttClient := mqtt.NewClient(options)
+	token := mqttClient.Connect()
+	assert.True(t, token.WaitTimeout(10*time.Second))
+	assert.Nil(t, token.Error())
+	assert.True(t, mqttClient.IsConnected())
+	mqttClient.Disconnect(100)
+}
+
+func TestMQTTClientRejectsBrokerSignedByAnUnknownCA(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "mqtttls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	ca := newTestCertificate(t, "test ca", true, nil)
+	otherCA := newTestCertificate(t, "other ca", true, nil)
+	server := newTestCertificate(t, "localhost", false, ca)
+	client := newTestCertificate(t, "growselocator", false, ca)
+	listener := startTLSBrokerStandIn(t, ca, server)
+	defer listener.Close()
+
+	testConfiguration := Configuration{
+		MQTTURL:            fmt.Sprintf("ssl://%v", listener.Addr().String()),
+		MQTTClientID:       "growselocator",
+		MQTTCACertFile:     writeTestFile(t, tempDir, "ca.pem", otherCA.certPEM),
+		MQTTClientCertFile: writeTestFile(t, tempDir, "client.pem", client.certPEM),
+		MQTTClientKeyFile:  writeTestFile(t, tempDir, "client.key", client.keyPEM),
+	}
+	options, err := buildMQTTClientOptions(testConfiguration)
+	assert.Nil(t, err)
+	options.SetAutoReconnect(false)
+	options.SetConnectTimeout(5 * time.Second)
+
+	mqttClient := mqtt.NewClient(options)
+	token := mqttClient.Connect()
+	assert.True(t, token.WaitTimeout(10*time.Second))
+	assert.NotNil(t, token.Error())
+}
+
+func TestPlainBrokerHasNoTLSConfig(t *testing.T) {
+	tlsConfig, err := buildMQTTTLSConfig(Configuration{MQTTURL: "tcp://localhost:1883"})
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+}
+
+func TestClientCertificateWithoutKeyIsAnError(t *testing.T) {
+	_, err := buildMQTTTLSConfig(Configuration{MQTTURL: "ssl://localhost:8883", MQTTClientCertFile: "client.pem"})
+	assert.NotNil(t, err)
+}
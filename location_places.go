@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/paulmach/go.geojson"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*
+Consecutive fixes in a place further apart than this are treated as separate visits, so the time away doesn't count as
+dwell
+*/
+const placeVisitGap = 30 * time.Minute
+
+/*
+Where to look for visits. An explicit radius wins, then a polygon, then a radius derived from the bounds or the
+geocoder's confidence
+*/
+type PlaceArea struct {
+	Latitude   float64
+	Longitude  float64
+	Radius     float64
+	Bounds     *Bounds
+	Geometry   *geojson.Geometry
+	Confidence int
+}
+
+/*
+Every day with a location in a place, with the first and last time we were there and how long we stayed
+*/
+type PlaceVisitDay struct {
+	Date          time.Time     `json:"date"`
+	LocationCount int           `json:"count"`
+	FirstVisit    time.Time     `json:"first"`
+	LastVisit     time.Time     `json:"last"`
+	Dwell         time.Duration `json:"-"`
+	DwellSeconds  int64         `json:"dwellSeconds"`
+}
+
+func placeAreaFromAddress(address Address, radius float64) PlaceArea {
+	return PlaceArea{
+		Latitude:   address.Latitude,
+		Longitude:  address.Longitude,
+		Radius:     radius,
+		Bounds:     address.Bounds,
+		Geometry:   address.Geometry,
+		Confidence: address.Confidence,
+	}
+}
+
+/*
+The radius we use for a geocoder confidence score when there's no better geometry to go on
+*/
+func confidenceRadius(confidence int) float64 {
+	switch confidence {
+	case 10:
+		return 250
+	case 9:
+		return 500
+	case 8:
+		return 1000
+	case 7:
+		return 5000
+	case 6:
+		return 7500
+	case 5:
+		return 10000
+	case 4:
+		return 15000
+	case 3:
+		return 20000
+	}
+	return 25000
+}
+
+/*
+Half the diagonal of the bounds, so the circle around the centre covers the whole place
+*/
+func (bounds *Bounds) radius() float64 {
+	return haversineDistance(bounds.South, bounds.West, bounds.North, bounds.East) / 2
+}
+
+/*
+The SQL condition matching locations within the area, and its arguments
+*/
+func placeAreaCondition(area PlaceArea) (string, []interface{}, error) {
+	const withinRadius = "ST_DWithin(point, ST_SetSRID(ST_Point($1, $2), 4326), $3)"
+	if area.Radius > 0 {
+		return withinRadius, []interface{}{area.Longitude, area.Latitude, area.Radius}, nil
+	}
+	if area.Geometry != nil && (area.Geometry.IsPolygon() || area.Geometry.IsMultiPolygon()) {
+		box, ok := geometryBox(area.Geometry)
+		if ok {
+			geometryJSON, err := json.Marshal(area.Geometry)
+			if err != nil {
+				return "", nil, err
+			}
+			// The box lets the index narrow things down before the exact containment test
+			return "point && ST_SetSRID(ST_MakeBox2D(ST_Point($1, $2), ST_Point($3, $4)), 4326) " +
+					"and ST_Within(point::geometry, ST_SetSRID(ST_GeomFromGeoJSON($5), 4326))",
+				[]interface{}{box.MinX, box.MinY, box.MaxX, box.MaxY, string(geometryJSON)}, nil
+		}
+	}
+	if area.Bounds != nil {
+		latitude, longitude := area.Latitude, area.Longitude
+		if latitude == 0 && longitude == 0 {
+			latitude = (area.Bounds.North + area.Bounds.South) / 2
+			longitude = (area.Bounds.East + area.Bounds.West) / 2
+		}
+		return withinRadius, []interface{}{longitude, latitude, math.Max(area.Bounds.radius(), 250)}, nil
+	}
+	if area.Confidence >= 1 && area.Confidence <= 10 {
+		return withinRadius, []interface{}{area.Longitude, area.Latitude, confidenceRadius(area.Confidence)}, nil
+	}
+	return "", nil, errors.New("No valid geometries found in geocoding response")
+}
+
+/*
+Days we've been in the area, most recent first
+*/
+func SearchPlaceVisits(area PlaceArea) ([]PlaceVisitDay, error) {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	condition, args, err := placeAreaCondition(area)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, fmt.Sprintf("%d seconds", int64(placeVisitGap.Seconds())))
+	query := "with matches as (" +
+		"select devicetimestamp, date(devicetimestamp) as day, " +
+		"lag(devicetimestamp) over (partition by username, device order by devicetimestamp) as previous " +
+		"from locations where not excluded and " + condition +
+		") " +
+		"select day, count(*), min(devicetimestamp), max(devicetimestamp), " +
+		"coalesce(sum(extract(epoch from devicetimestamp - previous)) filter (" +
+		"where date(previous) = day and devicetimestamp - previous <= $" + strconv.Itoa(len(args)) + "::interval), 0)::bigint " +
+		"from matches group by day order by day desc"
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []PlaceVisitDay{}
+	for rows.Next() {
+		var result PlaceVisitDay
+		err = rows.Scan(&result.Date, &result.LocationCount, &result.FirstVisit, &result.LastVisit, &result.DwellSeconds)
+		if err != nil {
+			return nil, err
+		}
+		result.Dwell = time.Duration(result.DwellSeconds) * time.Second
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+/*
+Geocode the place and find our visits to it. A place the geocoder doesn't know gives no address and no visits
+*/
+func SearchPlace(place string, radius float64) (*Address, []PlaceVisitDay, error) {
+	geocoding, err := GetGeocoding(place)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(geocoding) == 0 {
+		return nil, []PlaceVisitDay{}, nil
+	}
+	address := geocoding[0]
+	results, err := SearchPlaceVisits(placeAreaFromAddress(address, radius))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &address, results, nil
+}
+
+func parsePlaceRadius(radiusParam string) (float64, error) {
+	if radiusParam == "" {
+		return 0, nil
+	}
+	radius, err := strconv.ParseFloat(radiusParam, 64)
+	if err != nil || radius < 0 {
+		return 0, fmt.Errorf("Invalid radius %v", radiusParam)
+	}
+	return radius, nil
+}
+
+func PlaceHandler(c *gin.Context) {
+	if db == nil {
+		c.String(500, "No database connection available")
+		c.Abort()
+		return
+	}
+	place := c.PostForm("place")
+	radius, err := parsePlaceRadius(c.PostForm("radius"))
+	if err != nil {
+		c.String(400, err.Error())
+		c.Abort()
+		return
+	}
+	address, results, err := SearchPlace(place, radius)
+	if err != nil {
+		InternalError(err)
+		c.String(500, err.Error())
+		c.Abort()
+		return
+	}
+	if address == nil {
+		c.HTML(200, "placeResults", gin.H{"results": nil, "place": place, "radius": c.PostForm("radius")})
+		c.Abort()
+		return
+	}
+	c.HTML(200, "placeResults", gin.H{"results": results, "place": place, "radius": c.PostForm("radius"), "formatted": address.FormattedAddress})
+}
+
+/*
+The places search as JSON. Either geocodes q, or searches around lat/lon without geocoding
+*/
+func OTPlacesHandler(c *gin.Context) {
+	radius, err := parsePlaceRadius(c.Query("radius"))
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	var feature *geojson.Feature
+	var results []PlaceVisitDay
+	if c.Query("lat") != "" || c.Query("lon") != "" {
+		latitude, err := strconv.ParseFloat(c.Query("lat"), 64)
+		if err != nil {
+			c.String(400, fmt.Sprintf("Invalid lat %v", c.Query("lat")))
+			return
+		}
+		longitude, err := strconv.ParseFloat(c.Query("lon"), 64)
+		if err != nil {
+			c.String(400, fmt.Sprintf("Invalid lon %v", c.Query("lon")))
+			return
+		}
+		if radius == 0 {
+			radius = confidenceRadius(10)
+		}
+		feature = geojson.NewPointFeature([]float64{longitude, latitude})
+		feature.SetProperty("radius", radius)
+		results, err = SearchPlaceVisits(PlaceArea{Latitude: latitude, Longitude: longitude, Radius: radius})
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+	} else {
+		if c.Query("q") == "" {
+			c.String(400, "Either q or lat and lon are required")
+			return
+		}
+		var address *Address
+		address, results, err = SearchPlace(c.Query("q"), radius)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		if address != nil {
+			feature, err = address.Feature()
+			if err != nil {
+				c.String(500, err.Error())
+				return
+			}
+		}
+	}
+	locationCount := 0
+	for _, result := range results {
+		locationCount += result.LocationCount
+	}
+	c.JSON(200, gin.H{"feature": feature, "data": results, "days": len(results), "count": locationCount})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/paulmach/go.geojson"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPlaceAreaPrefersAnExplicitRadius(t *testing.T) {
+	area := PlaceArea{Latitude: 51.75, Longitude: -0.45, Radius: 300, Bounds: &Bounds{North: 52, South: 51, East: 0, West: -1}}
+	condition, args, err := placeAreaCondition(area)
+	assert.Nil(t, err)
+	assert.Contains(t, condition, "ST_DWithin")
+	assert.Equal(t, []interface{}{-0.45, 51.75, 300.0}, args)
+}
+
+func TestPlaceAreaUsesPolygonContainment(t *testing.T) {
+	polygon := geojson.NewPolygonGeometry([][][]float64{{{-0.5, 51.7}, {-0.4, 51.7}, {-0.4, 51.8}, {-0.5, 51.8}, {-0.5, 51.7}}})
+	condition, args, err := placeAreaCondition(PlaceArea{Geometry: polygon, Confidence: 10})
+	assert.Nil(t, err)
+	assert.Contains(t, condition, "ST_Within")
+	assert.Equal(t, []interface{}{-0.5, 51.7, -0.4, 51.8}, args[:4])
+}
+
+func TestPlaceAreaDerivesARadiusFromBounds(t *testing.T) {
+	bounds := &Bounds{North: 51.01, South: 51, East: 0.01, West: 0}
+	_, args, err := placeAreaCondition(PlaceArea{Bounds: bounds})
+	assert.Nil(t, err)
+	assert.Equal(t, 0.005, args[0])
+	assert.InDelta(t, 655, args[2].(float64), 5)
+}
+
+func TestPlaceAreaFallsBackToConfidence(t *testing.T) {
+	_, args, err := placeAreaCondition(PlaceArea{Latitude: 51.75, Longitude: -0.45, Confidence: 9})
+	assert.Nil(t, err)
+	assert.Equal(t, 500.0, args[2])
+	_, _, err = placeAreaCondition(PlaceArea{Latitude: 51.75, Longitude: -0.45})
+	assert.NotNil(t, err)
+}
+
+func placesTestRequest(url string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/places", OTPlacesHandler)
+	request, _ := http.NewRequest("GET", url, nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestPlacesAPINeedsAQueryOrCoordinates(t *testing.T) {
+	assert.Equal(t, 400, placesTestRequest("/places").Code)
+	assert.Equal(t, 400, placesTestRequest("/places?lat=51.7").Code)
+	assert.Equal(t, 400, placesTestRequest("/places?q=hemel&radius=far").Code)
+}
+
+func TestAddressFeatureFallsBackToAPoint(t *testing.T) {
+	address := Address{Provider: "nominatim", FormattedAddress: "Hemel Hempstead", PostalTown: "Hemel Hempstead", Latitude: 51.75, Longitude: -0.45}
+	feature, err := address.Feature()
+	assert.Nil(t, err)
+	assert.True(t, feature.Geometry.IsPoint())
+	assert.Equal(t, []float64{-0.45, 51.75}, feature.Geometry.Point)
+	assert.Equal(t, "Hemel Hempstead", feature.Properties["name"])
+	assert.Equal(t, "nominatim", feature.Properties["provider"])
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Locations that couldn't be stored because the database was unavailable. Each one is a file in the queue directory, so
+they survive a restart
+*/
+type LocationRetryQueue struct {
+	directory string
+	mutex     sync.Mutex
+	sequence  uint64
+}
+
+type locationRetryEntry struct {
+	User    string
+	Device  string
+	Raw     json.RawMessage
+	Locator MQTTMsg
+}
+
+func NewLocationRetryQueue(directory string) (*LocationRetryQueue, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &LocationRetryQueue{directory: directory}, nil
+}
+
+func (queue *LocationRetryQueue) Enqueue(locator MQTTMsg) error {
+	entry := locationRetryEntry{User: locator.User, Device: locator.Device, Raw: locator.Raw, Locator: locator}
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), atomic.AddUint64(&queue.sequence, 1))
+	tempFile, err := ioutil.TempFile(queue.directory, ".pending-")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(entryBytes)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), filepath.Join(queue.directory, name))
+}
+
+/*
+Queued files, oldest first
+*/
+func (queue *LocationRetryQueue) Pending() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(queue.directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+/*
+Try to insert everything in the queue. Stops at the first failure, as the database is probably still unavailable
+*/
+func (queue *LocationRetryQueue) Drain(insert func(MQTTMsg) (InsertResult, error)) (int, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	files, err := queue.Pending()
+	if err != nil {
+		return 0, err
+	}
+	drained := 0
+	for _, file := range files {
+		entryBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return drained, err
+		}
+		var entry locationRetryEntry
+		err = json.Unmarshal(entryBytes, &entry)
+		if err != nil {
+			log.Printf("Discarding unreadable retry queue entry %v: %v", file, err)
+			os.Remove(file)
+			continue
+		}
+		locator := entry.Locator
+		locator.User = entry.User
+		locator.Device = entry.Device
+		if string(entry.Raw) != "null" {
+			locator.Raw = entry.Raw
+		}
+		result, err := insert(locator)
+		if result == InsertResultFailed {
+			return drained, err
+		}
+		if result == InsertResultRejected {
+			log.Printf("Discarding retry queue entry %v rejected by database: %v", file, err)
+		}
+		err = os.Remove(file)
+		if err != nil {
+			return drained, err
+		}
+		drained++
+	}
+	return drained, nil
+}
+
+func (queue *LocationRetryQueue) Run(interval time.Duration, quit <-chan bool) {
+	log.Printf("Starting location retry queue in %v", queue.directory)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			drained, err := queue.Drain(insertLocationToDatabase)
+			if drained > 0 {
+				log.Printf("Inserted %d queued locations", drained)
+			}
+			if err != nil {
+				log.Printf("Error draining location retry queue: %v", err)
+			}
+		case <-quit:
+			log.Print("Quitting location retry queue")
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryQueueDrainsQueuedLocationsInOrder(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "retryqueue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	queue, err := NewLocationRetryQueue(tempDir)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Enqueue(MQTTMsg{Type: "location", Latitude: 1, User: "growse", Device: "nexus5", Raw: []byte("{\"_type\":\"location\"}"), DeviceTimestamp: time.Unix(1483358150, 0)}))
+	assert.Nil(t, queue.Enqueue(MQTTMsg{Type: "location", Latitude: 2, User: "growse", Device: "nexus5"}))
+
+	var inserted []MQTTMsg
+	drained, err := queue.Drain(func(locator MQTTMsg) (InsertResult, error) {
+		inserted = append(inserted, locator)
+		return InsertResultInserted, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, drained)
+	assert.Equal(t, float64(1), inserted[0].Latitude)
+	assert.Equal(t, "growse", inserted[0].User)
+	assert.Equal(t, "nexus5", inserted[0].Device)
+	assert.Equal(t, "{\"_type\":\"location\"}", string(inserted[0].Raw))
+	assert.True(t, inserted[0].DeviceTimestamp.Equal(time.Unix(1483358150, 0)))
+	assert.Equal(t, float64(2), inserted[1].Latitude)
+
+	pending, err := queue.Pending()
+	assert.Nil(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestRetryQueueKeepsLocationsWhenTheDatabaseIsStillUnavailable(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "retryqueue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	queue, err := NewLocationRetryQueue(tempDir)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Enqueue(MQTTMsg{Type: "location", Latitude: 1}))
+	assert.Nil(t, queue.Enqueue(MQTTMsg{Type: "location", Latitude: 2}))
+
+	drained, err := queue.Drain(func(locator MQTTMsg) (InsertResult, error) {
+		return InsertResultFailed, errors.New("connection refused")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, drained)
+	pending, err := queue.Pending()
+	assert.Nil(t, err)
+	assert.Len(t, pending, 2)
+}
+
+func TestRetryQueueDiscardsDuplicatesAndRejections(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "retryqueue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	queue, err := NewLocationRetryQueue(tempDir)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Enqueue(MQTTMsg{Type: "location", Latitude: 1}))
+	assert.Nil(t, queue.Enqueue(MQTTMsg{Type: "location", Latitude: 2}))
+
+	results := []InsertResult{InsertResultDuplicate, InsertResultRejected}
+	drained, err := queue.Drain(func(locator MQTTMsg) (InsertResult, error) {
+		result := results[0]
+		results = results[1:]
+		return result, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, drained)
+	pending, err := queue.Pending()
+	assert.Nil(t, err)
+	assert.Empty(t, pending)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const rtreeNodeCapacity = 16
+
+type rtreeBox struct {
+	MinX float64
+	MinY float64
+	MaxX float64
+	MaxY float64
+}
+
+func (box rtreeBox) contains(x float64, y float64) bool {
+	return x >= box.MinX && x <= box.MaxX && y >= box.MinY && y <= box.MaxY
+}
+
+func (box rtreeBox) intersects(other rtreeBox) bool {
+	return box.MinX <= other.MaxX && box.MaxX >= other.MinX && box.MinY <= other.MaxY && box.MaxY >= other.MinY
+}
+
+func (box rtreeBox) extend(other rtreeBox) rtreeBox {
+	return rtreeBox{
+		MinX: math.Min(box.MinX, other.MinX),
+		MinY: math.Min(box.MinY, other.MinY),
+		MaxX: math.Max(box.MaxX, other.MaxX),
+		MaxY: math.Max(box.MaxY, other.MaxY),
+	}
+}
+
+/*
+A static R-tree, bulk loaded with Sort-Tile-Recursive packing. Leaves hold indexes into whatever slice the boxes came
+from
+*/
+type rtree struct {
+	root *rtreeNode
+}
+
+type rtreeNode struct {
+	box      rtreeBox
+	children []*rtreeNode
+	items    []int
+}
+
+func newRTree(boxes []rtreeBox) *rtree {
+	if len(boxes) == 0 {
+		return &rtree{}
+	}
+	nodes := make([]*rtreeNode, len(boxes))
+	for i, box := range boxes {
+		nodes[i] = &rtreeNode{box: box, items: []int{i}}
+	}
+	// The first pass packs items into leaves, later passes pack nodes into parents
+	leaves := true
+	for len(nodes) > 1 || leaves {
+		nodes = packRTreeLevel(nodes, leaves)
+		leaves = false
+	}
+	return &rtree{root: nodes[0]}
+}
+
+func packRTreeLevel(nodes []*rtreeNode, leaves bool) []*rtreeNode {
+	parentCount := int(math.Ceil(float64(len(nodes)) / rtreeNodeCapacity))
+	slabCount := int(math.Ceil(math.Sqrt(float64(parentCount))))
+	slabSize := slabCount * rtreeNodeCapacity
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].box.MinX+nodes[i].box.MaxX < nodes[j].box.MinX+nodes[j].box.MaxX
+	})
+	var parents []*rtreeNode
+	for slabStart := 0; slabStart < len(nodes); slabStart += slabSize {
+		slab := nodes[slabStart:minInt(slabStart+slabSize, len(nodes))]
+		sort.Slice(slab, func(i, j int) bool {
+			return slab[i].box.MinY+slab[i].box.MaxY < slab[j].box.MinY+slab[j].box.MaxY
+		})
+		for start := 0; start < len(slab); start += rtreeNodeCapacity {
+			group := slab[start:minInt(start+rtreeNodeCapacity, len(slab))]
+			parent := &rtreeNode{box: group[0].box}
+			for _, node := range group {
+				parent.box = parent.box.extend(node.box)
+				if leaves {
+					parent.items = append(parent.items, node.items...)
+				} else {
+					parent.children = append(parent.children, node)
+				}
+			}
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+/*
+Indexes of every box that intersects the search box. Leaf items are only filtered by their parent's box, so callers
+still need to check the items themselves
+*/
+func (tree *rtree) Search(box rtreeBox) []int {
+	var found []int
+	if tree.root != nil {
+		tree.root.search(box, &found)
+	}
+	return found
+}
+
+func (node *rtreeNode) search(box rtreeBox, found *[]int) {
+	if !node.box.intersects(box) {
+		return
+	}
+	*found = append(*found, node.items...)
+	for _, child := range node.children {
+		child.search(box, found)
+	}
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
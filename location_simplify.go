@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*
+No fixes for this long and the track is broken, so the points either side of it always survive
+*/
+const trackGap = 15 * time.Minute
+
+/*
+How many fixes of one device we hold before simplifying what we've got and carrying on
+*/
+const simplifyBufferSize = 10000
+
+/*
+Tolerance is how far in metres a dropped fix can be from the simplified line. Bucket keeps at most one fix per bucket
+of time. Stops are stay points, as visits define them, and their first and last fixes are always kept
+*/
+type SimplifyOptions struct {
+	Tolerance    float64
+	Bucket       time.Duration
+	StopDistance float64
+	StopDuration time.Duration
+}
+
+func (options SimplifyOptions) enabled() bool {
+	return options.Tolerance > 0 || options.Bucket > 0
+}
+
+/*
+Metres per pixel at the equator for a slippy map zoom level
+*/
+func zoomTolerance(zoom int) float64 {
+	return 156543.03392 / math.Pow(2, float64(zoom))
+}
+
+func parseSimplifyOptions(tolerance string, zoom string, bucket string) (SimplifyOptions, error) {
+	options := SimplifyOptions{
+		StopDistance: configuration.VisitMaxDistance,
+		StopDuration: time.Duration(configuration.VisitMinMinutes) * time.Minute,
+	}
+	if tolerance != "" {
+		metres, err := strconv.ParseFloat(tolerance, 64)
+		if err != nil || metres < 0 {
+			return options, fmt.Errorf("Invalid tolerance %v", tolerance)
+		}
+		options.Tolerance = metres
+	} else if zoom != "" {
+		level, err := strconv.Atoi(zoom)
+		if err != nil || level < 0 || level > 24 {
+			return options, fmt.Errorf("Invalid zoom %v", zoom)
+		}
+		options.Tolerance = zoomTolerance(level)
+	}
+	if bucket != "" {
+		minutes, err := strconv.Atoi(bucket)
+		if err != nil || minutes < 0 {
+			return options, fmt.Errorf("Invalid bucket %v", bucket)
+		}
+		options.Bucket = time.Duration(minutes) * time.Minute
+	}
+	return options, nil
+}
+
+/*
+Simplifies one device's fixes, which must be in time order. The track is cut at gaps and at the ends of stops, and each
+piece is bucketed and then Douglas-Peucker'd on its own, so the cuts are always kept
+*/
+func SimplifyTrack(points []Location, options SimplifyOptions) []Location {
+	if len(points) < 3 {
+		return points
+	}
+	anchors := make([]bool, len(points))
+	anchors[0] = true
+	anchors[len(points)-1] = true
+	for i := 1; i < len(points); i++ {
+		if points[i].DeviceTimestamp.Sub(points[i-1].DeviceTimestamp) > trackGap {
+			anchors[i-1] = true
+			anchors[i] = true
+		}
+	}
+	if options.StopDuration > 0 {
+		stays, _ := DetectStayPoints(points, options.StopDistance, options.StopDuration)
+		markStayAnchors(points, stays, anchors)
+	}
+	var simplified []Location
+	start := 0
+	for i := 1; i < len(points); i++ {
+		if !anchors[i] {
+			continue
+		}
+		piece := simplifyPiece(points[start:i+1], options)
+		// The end of this piece is the start of the next
+		simplified = append(simplified, piece[:len(piece)-1]...)
+		start = i
+	}
+	return append(simplified, points[len(points)-1])
+}
+
+func markStayAnchors(points []Location, stays []StayPoint, anchors []bool) {
+	i := 0
+	for _, stay := range stays {
+		for i < len(points) && points[i].DeviceTimestamp.Before(stay.Arrival) {
+			i++
+		}
+		if i < len(points) {
+			anchors[i] = true
+		}
+		for i < len(points) && !points[i].DeviceTimestamp.After(stay.Departure) {
+			i++
+		}
+		if i > 0 {
+			anchors[i-1] = true
+		}
+	}
+}
+
+func simplifyPiece(points []Location, options SimplifyOptions) []Location {
+	if options.Bucket > 0 {
+		points = bucketTrack(points, options.Bucket)
+	}
+	if options.Tolerance > 0 {
+		points = douglasPeucker(points, options.Tolerance)
+	}
+	return points
+}
+
+/*
+The first fix in each bucket, plus the last fix so the piece still ends where it did
+*/
+func bucketTrack(points []Location, bucket time.Duration) []Location {
+	if len(points) < 3 {
+		return points
+	}
+	bucketed := []Location{points[0]}
+	current := points[0].DeviceTimestamp.Truncate(bucket)
+	for _, point := range points[1 : len(points)-1] {
+		if start := point.DeviceTimestamp.Truncate(bucket); start.After(current) {
+			bucketed = append(bucketed, point)
+			current = start
+		}
+	}
+	return append(bucketed, points[len(points)-1])
+}
+
+/*
+Iterative rather than recursive, a day of fixes on a straight road would otherwise go very deep
+*/
+func douglasPeucker(points []Location, tolerance float64) []Location {
+	if len(points) < 3 {
+		return points
+	}
+	keep := make([]bool, len(points))
+	keep[0] = true
+	keep[len(points)-1] = true
+	latitudeScale := math.Cos(points[0].Latitude * math.Pi / 180)
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		furthest, furthestDistance := -1, tolerance
+		for i := first + 1; i < last; i++ {
+			distance := segmentDistance(points[i], points[first], points[last], latitudeScale)
+			if distance > furthestDistance {
+				furthest, furthestDistance = i, distance
+			}
+		}
+		if furthest >= 0 {
+			keep[furthest] = true
+			stack = append(stack, [2]int{first, furthest}, [2]int{furthest, last})
+		}
+	}
+	var simplified []Location
+	for i, point := range points {
+		if keep[i] {
+			simplified = append(simplified, point)
+		}
+	}
+	return simplified
+}
+
+/*
+Metres from point to the line segment start-end, on a flat projection that's plenty accurate over the length of a track
+segment
+*/
+func segmentDistance(point Location, start Location, end Location, latitudeScale float64) float64 {
+	const metresPerDegree = 111319.49
+	x := (point.Longitude - start.Longitude) * latitudeScale * metresPerDegree
+	y := (point.Latitude - start.Latitude) * metresPerDegree
+	dx := (end.Longitude - start.Longitude) * latitudeScale * metresPerDegree
+	dy := (end.Latitude - start.Latitude) * metresPerDegree
+	lengthSquared := dx*dx + dy*dy
+	if lengthSquared == 0 {
+		return math.Hypot(x, y)
+	}
+	t := math.Max(0, math.Min(1, (x*dx+y*dy)/lengthSquared))
+	return math.Hypot(x-t*dx, y-t*dy)
+}
+
+/*
+Feeds a newest first stream through SimplifyTrack a device at a time, passing on what survives in the same order. A
+device with more than simplifyBufferSize fixes is done in chunks, each starting where the last one finished
+*/
+func simplifyStream(options SimplifyOptions, each func(*Location) error) (func(*Location) error, func() error) {
+	var buffer []Location
+	flush := func(final bool) error {
+		if len(buffer) == 0 {
+			return nil
+		}
+		ascending := make([]Location, len(buffer))
+		for i := range buffer {
+			ascending[len(buffer)-1-i] = buffer[i]
+		}
+		simplified := SimplifyTrack(ascending, options)
+		// The oldest fix is kept either way, and carried over when the device continues
+		end := 0
+		if !final {
+			end = 1
+		}
+		for i := len(simplified) - 1; i >= end; i-- {
+			if err := each(&simplified[i]); err != nil {
+				return err
+			}
+		}
+		if final {
+			buffer = buffer[:0]
+		} else {
+			buffer = append(buffer[:0], simplified[0])
+		}
+		return nil
+	}
+	add := func(location *Location) error {
+		if len(buffer) > 0 && (buffer[0].User != location.User || buffer[0].Device != location.Device) {
+			if err := flush(true); err != nil {
+				return err
+			}
+		}
+		buffer = append(buffer, *location)
+		if len(buffer) >= simplifyBufferSize {
+			return flush(false)
+		}
+		return nil
+	}
+	return add, func() error {
+		return flush(true)
+	}
+}
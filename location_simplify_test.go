@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var simplifyTestStart = time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+
+/*
+Fixes a minute apart heading east along the equator, roughly 111m per 0.001 degrees
+*/
+func straightTrack(count int) []Location {
+	var points []Location
+	for i := 0; i < count; i++ {
+		points = append(points, Location{User: "growse", Device: "nexus5", Longitude: float64(i) * 0.001, DeviceTimestamp: simplifyTestStart.Add(time.Duration(i) * time.Minute)})
+	}
+	return points
+}
+
+func TestDouglasPeuckerDropsPointsOnAStraightLine(t *testing.T) {
+	simplified := SimplifyTrack(straightTrack(10), SimplifyOptions{Tolerance: 10})
+	assert.Len(t, simplified, 2)
+	assert.Equal(t, 0.0, simplified[0].Longitude)
+	assert.InDelta(t, 0.009, simplified[1].Longitude, 1e-9)
+}
+
+func TestDouglasPeuckerKeepsCorners(t *testing.T) {
+	points := straightTrack(10)
+	// Turn north at the sixth fix
+	for i := 6; i < len(points); i++ {
+		points[i].Longitude = 0.005
+		points[i].Latitude = float64(i-5) * 0.001
+	}
+	simplified := SimplifyTrack(points, SimplifyOptions{Tolerance: 10})
+	assert.Len(t, simplified, 3)
+	assert.InDelta(t, 0.005, simplified[1].Longitude, 1e-9)
+	assert.Equal(t, 0.0, simplified[1].Latitude)
+	assert.Len(t, SimplifyTrack(points, SimplifyOptions{Tolerance: 5000}), 2)
+}
+
+func TestSimplifyKeepsBothSidesOfAGap(t *testing.T) {
+	points := straightTrack(10)
+	for i := 5; i < len(points); i++ {
+		points[i].DeviceTimestamp = points[i].DeviceTimestamp.Add(time.Hour)
+	}
+	simplified := SimplifyTrack(points, SimplifyOptions{Tolerance: 10})
+	assert.Len(t, simplified, 4)
+	assert.Equal(t, 0.004, simplified[1].Longitude)
+	assert.Equal(t, 0.005, simplified[2].Longitude)
+}
+
+func TestSimplifyKeepsTheEndsOfAStop(t *testing.T) {
+	points := straightTrack(20)
+	// Sit still at 0.005 from minute 5 to minute 14, then carry on
+	for i := 5; i < 15; i++ {
+		points[i].Longitude = 0.005
+	}
+	for i := 15; i < 20; i++ {
+		points[i].Longitude = 0.005 + float64(i-14)*0.001
+	}
+	simplified := SimplifyTrack(points, SimplifyOptions{Tolerance: 10, StopDistance: 50, StopDuration: 5 * time.Minute})
+	var times []time.Time
+	for _, point := range simplified {
+		times = append(times, point.DeviceTimestamp)
+	}
+	assert.Contains(t, times, simplifyTestStart.Add(5*time.Minute))
+	assert.Contains(t, times, simplifyTestStart.Add(14*time.Minute))
+	assert.Len(t, simplified, 4)
+}
+
+func TestBucketKeepsOnePointPerBucket(t *testing.T) {
+	simplified := SimplifyTrack(straightTrack(31), SimplifyOptions{Bucket: 10 * time.Minute})
+	assert.Len(t, simplified, 4)
+	assert.Equal(t, simplifyTestStart.Add(10*time.Minute), simplified[1].DeviceTimestamp)
+	assert.Equal(t, simplifyTestStart.Add(30*time.Minute), simplified[3].DeviceTimestamp)
+}
+
+func TestSimplifyStreamKeepsNewestFirstOrderPerDevice(t *testing.T) {
+	var emitted []Location
+	add, finish := simplifyStream(SimplifyOptions{Tolerance: 10}, func(location *Location) error {
+		emitted = append(emitted, *location)
+		return nil
+	})
+	nexus := straightTrack(10)
+	for i := len(nexus) - 1; i >= 0; i-- {
+		assert.Nil(t, add(&nexus[i]))
+	}
+	pixel := straightTrack(3)
+	for i := len(pixel) - 1; i >= 0; i-- {
+		pixel[i].Device = "pixel"
+		pixel[i].Latitude = 0.01 * float64(i%2)
+		assert.Nil(t, add(&pixel[i]))
+	}
+	assert.Nil(t, finish())
+	assert.Len(t, emitted, 5)
+	assert.Equal(t, "nexus5", emitted[0].Device)
+	assert.InDelta(t, 0.009, emitted[0].Longitude, 1e-9)
+	assert.Equal(t, 0.0, emitted[1].Longitude)
+	assert.Equal(t, "pixel", emitted[2].Device)
+	assert.True(t, emitted[2].DeviceTimestamp.After(emitted[3].DeviceTimestamp))
+}
+
+func TestParseSimplifyOptions(t *testing.T) {
+	options, err := parseSimplifyOptions("", "", "")
+	assert.Nil(t, err)
+	assert.False(t, options.enabled())
+	options, err = parseSimplifyOptions("", "10", "5")
+	assert.Nil(t, err)
+	assert.InDelta(t, 152.87, options.Tolerance, 0.01)
+	assert.Equal(t, 5*time.Minute, options.Bucket)
+	options, err = parseSimplifyOptions("25", "10", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 25.0, options.Tolerance)
+	_, err = parseSimplifyOptions("", "zoomed", "")
+	assert.NotNil(t, err)
+}
+
+func TestSimplifyStreamChunksLongTracksWithoutDuplicates(t *testing.T) {
+	var emitted []Location
+	add, finish := simplifyStream(SimplifyOptions{Tolerance: 10}, func(location *Location) error {
+		emitted = append(emitted, *location)
+		return nil
+	})
+	points := straightTrack(simplifyBufferSize*2 + 500)
+	for i := range points {
+		// Seconds apart so there are no gaps
+		points[i].DeviceTimestamp = simplifyTestStart.Add(time.Duration(i) * time.Second)
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		assert.Nil(t, add(&points[i]))
+	}
+	assert.Nil(t, finish())
+	assert.Len(t, emitted, 4)
+	for i := 1; i < len(emitted); i++ {
+		assert.True(t, emitted[i-1].DeviceTimestamp.After(emitted[i].DeviceTimestamp))
+	}
+	assert.Equal(t, simplifyTestStart, emitted[len(emitted)-1].DeviceTimestamp)
+}
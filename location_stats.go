@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"sort"
+	"time"
+)
+
+/*
+A row of locationstats_daily, which triggers on locations keep up to date. Distance is in metres
+*/
+type DailyLocationStats struct {
+	User          string
+	Device        string
+	Day           time.Time
+	Distance      float64
+	ActiveSeconds int64
+	MaxAltitude   float64
+	Countries     []string
+	Places        []string
+	Points        int
+}
+
+type LocationStats struct {
+	User          string    `json:"username"`
+	Device        string    `json:"device"`
+	Period        string    `json:"period"`
+	Start         time.Time `json:"start"`
+	Distance      float64   `json:"distance"`
+	ActiveSeconds int64     `json:"activeSeconds"`
+	MaxAltitude   float64   `json:"maxAltitude"`
+	Countries     []string  `json:"countries"`
+	Places        []string  `json:"places"`
+	Points        int       `json:"points"`
+	Days          int       `json:"days"`
+}
+
+func GetDailyLocationStats(from time.Time, to time.Time, user string, device string) ([]DailyLocationStats, error) {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	rows, err := db.Query("select username, device, day, distance, activeseconds, coalesce(maxaltitude, 0), countries, places, points "+
+		"from locationstats_daily where day >= $1 and day < $2 and ($3 = '' or username = $3) and ($4 = '' or device = $4) "+
+		"order by day, username, device", from, to, user, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []DailyLocationStats
+	for rows.Next() {
+		var day DailyLocationStats
+		err = rows.Scan(&day.User, &day.Device, &day.Day, &day.Distance, &day.ActiveSeconds, &day.MaxAltitude,
+			pq.Array(&day.Countries), pq.Array(&day.Places), &day.Points)
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+/*
+The start of the day, ISO week, month or year containing the day
+*/
+func periodStart(day time.Time, period string) (time.Time, error) {
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "day":
+		return day, nil
+	case "week":
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)), nil
+	case "month":
+		return day.AddDate(0, 0, 1-day.Day()), nil
+	case "year":
+		return time.Date(day.Year(), 1, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid period %v", period)
+}
+
+/*
+Combine daily stats into one entry per device per period, in time order
+*/
+func RollupLocationStats(days []DailyLocationStats, period string) ([]LocationStats, error) {
+	type rollupKey struct {
+		User   string
+		Device string
+		Start  time.Time
+	}
+	rollups := make(map[rollupKey]*LocationStats)
+	var keys []rollupKey
+	for _, day := range days {
+		start, err := periodStart(day.Day, period)
+		if err != nil {
+			return nil, err
+		}
+		key := rollupKey{User: day.User, Device: day.Device, Start: start}
+		stats, ok := rollups[key]
+		if !ok {
+			stats = &LocationStats{User: day.User, Device: day.Device, Period: period, Start: start, Countries: []string{}, Places: []string{}}
+			rollups[key] = stats
+			keys = append(keys, key)
+		}
+		stats.Distance += day.Distance
+		stats.ActiveSeconds += day.ActiveSeconds
+		stats.Points += day.Points
+		stats.Days++
+		if day.MaxAltitude > stats.MaxAltitude {
+			stats.MaxAltitude = day.MaxAltitude
+		}
+		for _, country := range day.Countries {
+			if !stringSliceContains(stats.Countries, country) {
+				stats.Countries = append(stats.Countries, country)
+			}
+		}
+		for _, place := range day.Places {
+			if !stringSliceContains(stats.Places, place) {
+				stats.Places = append(stats.Places, place)
+			}
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Start.Before(keys[j].Start)
+	})
+	results := make([]LocationStats, len(keys))
+	for i, key := range keys {
+		results[i] = *rollups[key]
+		sort.Strings(results[i].Countries)
+		sort.Strings(results[i].Places)
+	}
+	return results, nil
+}
+
+func OTStatsHandler(c *gin.Context) {
+	const dateFormat = "2006-01-02"
+	period := c.DefaultQuery("period", "month")
+	from := c.DefaultQuery("from", fmt.Sprintf("%d-01-01", time.Now().Year()))
+	to := c.DefaultQuery("to", time.Now().AddDate(0, 0, 1).Format(dateFormat))
+	fromTime, err := time.Parse(dateFormat, from)
+	if err != nil {
+		c.String(400, fmt.Sprintf("Invalid from date %v: %v", from, err))
+		return
+	}
+	toTime, err := time.Parse(dateFormat, to)
+	if err != nil {
+		c.String(400, fmt.Sprintf("Invalid to date %v: %v", to, err))
+		return
+	}
+	if _, err := periodStart(fromTime, period); err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	days, err := GetDailyLocationStats(fromTime, toTime, c.Query("user"), c.Query("device"))
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	stats, err := RollupLocationStats(days, period)
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"data": stats})
+}
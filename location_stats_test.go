@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPeriodStarts(t *testing.T) {
+	// A Sunday
+	day := time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC)
+	for period, expected := range map[string]time.Time{
+		"day":   day,
+		"week":  time.Date(2020, 3, 9, 0, 0, 0, 0, time.UTC),
+		"month": time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		"year":  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		start, err := periodStart(day, period)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, start, period)
+	}
+	_, err := periodStart(day, "fortnight")
+	assert.NotNil(t, err)
+}
+
+func TestDailyStatsRollUpPerDevice(t *testing.T) {
+	days := []DailyLocationStats{
+		{User: "growse", Device: "nexus5", Day: time.Date(2020, 3, 9, 0, 0, 0, 0, time.UTC), Distance: 1000, ActiveSeconds: 60, MaxAltitude: 120, Countries: []string{"United Kingdom"}, Places: []string{"Hemel Hempstead"}, Points: 10},
+		{User: "growse", Device: "pixel", Day: time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC), Distance: 5, Points: 1},
+		{User: "growse", Device: "nexus5", Day: time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC), Distance: 500, ActiveSeconds: 30, MaxAltitude: 80, Countries: []string{"France", "United Kingdom"}, Places: []string{"Calais"}, Points: 5},
+		{User: "growse", Device: "nexus5", Day: time.Date(2020, 3, 16, 0, 0, 0, 0, time.UTC), Distance: 1, Points: 1},
+	}
+	stats, err := RollupLocationStats(days, "week")
+	assert.Nil(t, err)
+	assert.Len(t, stats, 3)
+	assert.Equal(t, "nexus5", stats[0].Device)
+	assert.Equal(t, 1500.0, stats[0].Distance)
+	assert.Equal(t, int64(90), stats[0].ActiveSeconds)
+	assert.Equal(t, 120.0, stats[0].MaxAltitude)
+	assert.Equal(t, []string{"France", "United Kingdom"}, stats[0].Countries)
+	assert.Equal(t, []string{"Calais", "Hemel Hempstead"}, stats[0].Places)
+	assert.Equal(t, 2, stats[0].Days)
+	assert.Equal(t, "pixel", stats[1].Device)
+	assert.Equal(t, time.Date(2020, 3, 16, 0, 0, 0, 0, time.UTC), stats[2].Start)
+}
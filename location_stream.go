@@ -0,0 +1,175 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Where a page of locations stopped. Timestamps aren't unique across devices so the id breaks ties
+*/
+type LocationCursor struct {
+	DeviceTimestamp time.Time
+	ID              int64
+}
+
+func (cursor LocationCursor) String() string {
+	plain := cursor.DeviceTimestamp.UTC().Format(time.RFC3339Nano) + "," + strconv.FormatInt(cursor.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(plain))
+}
+
+func parseLocationCursor(value string) (*LocationCursor, error) {
+	plain, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %v", value)
+	}
+	parts := strings.SplitN(string(plain), ",", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor %v", value)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %v", value)
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %v", value)
+	}
+	return &LocationCursor{DeviceTimestamp: timestamp, ID: id}, nil
+}
+
+/*
+Something that changes whenever the devices' rows do. A trigger gives a device a new revision on every insert, update
+or delete of its locations, so this is a lookup rather than a look at the range. The query string, which has the range
+in it, is hashed in so every page gets its own tag
+*/
+func LocationsETag(user string, device string, query string) (string, error) {
+	if db == nil {
+		return "", errors.New("No database connection available")
+	}
+	defer timeTrack(time.Now())
+	var revision int64
+	err := db.QueryRow("select coalesce(max(revision), 0) from locationrevisions where "+userDeviceFilter(1), user, device).Scan(&revision)
+	if err != nil {
+		return "", err
+	}
+	return locationsETag(revision, query), nil
+}
+
+func locationsETag(revision int64, query string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(query))
+	// Weak, because the gzipped and plain bodies aren't byte for byte the same
+	return fmt.Sprintf(`W/"%d-%x"`, revision, hash.Sum32())
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Writes {"data": [...]} one element at a time. Nothing is sent until the first element, so an error before then can still
+be answered with a proper status
+*/
+type jsonDataStream struct {
+	c       *gin.Context
+	writer  io.Writer
+	gzipped *gzip.Writer
+	encoder *json.Encoder
+	started bool
+}
+
+func newJSONDataStream(c *gin.Context) *jsonDataStream {
+	return &jsonDataStream{c: c}
+}
+
+func (stream *jsonDataStream) start() error {
+	if stream.started {
+		return nil
+	}
+	stream.started = true
+	stream.c.Header("Content-Type", "application/json")
+	stream.c.Header("Vary", "Accept-Encoding")
+	stream.writer = stream.c.Writer
+	if strings.Contains(stream.c.GetHeader("Accept-Encoding"), "gzip") {
+		stream.c.Header("Content-Encoding", "gzip")
+		stream.gzipped = gzip.NewWriter(stream.c.Writer)
+		stream.writer = stream.gzipped
+	}
+	stream.c.Status(200)
+	stream.encoder = json.NewEncoder(stream.writer)
+	_, err := io.WriteString(stream.writer, `{"data":[`)
+	return err
+}
+
+func (stream *jsonDataStream) Write(element interface{}) error {
+	first := !stream.started
+	err := stream.start()
+	if err != nil {
+		return err
+	}
+	if !first {
+		_, err = io.WriteString(stream.writer, ",")
+		if err != nil {
+			return err
+		}
+	}
+	return stream.encoder.Encode(element)
+}
+
+/*
+Closes the array and adds any other fields to the object
+*/
+func (stream *jsonDataStream) Close(fields gin.H) error {
+	err := stream.start()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(stream.writer, "]")
+	if err != nil {
+		return err
+	}
+	for key, value := range fields {
+		keyBytes, _ := json.Marshal(key)
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(stream.writer, ",%s:%s", keyBytes, valueBytes)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(stream.writer, "}")
+	if err != nil {
+		return err
+	}
+	return stream.Abort()
+}
+
+/*
+Flushes whatever was written. After an error part way through, the truncated JSON is how the client finds out
+*/
+func (stream *jsonDataStream) Abort() error {
+	if stream.gzipped != nil {
+		err := stream.gzipped.Close()
+		stream.gzipped = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLocationCursorRoundTrips(t *testing.T) {
+	cursor := LocationCursor{DeviceTimestamp: time.Date(2020, 6, 1, 9, 0, 0, 123000000, time.UTC), ID: 42}
+	parsed, err := parseLocationCursor(cursor.String())
+	assert.Nil(t, err)
+	assert.True(t, parsed.DeviceTimestamp.Equal(cursor.DeviceTimestamp))
+	assert.Equal(t, int64(42), parsed.ID)
+	_, err = parseLocationCursor("not a cursor")
+	assert.NotNil(t, err)
+}
+
+func TestETagMatchesIgnoresWeakness(t *testing.T) {
+	etag := locationsETag(99, "from=2020-06-01T00:00:00")
+	assert.True(t, etagMatches(etag, etag))
+	assert.True(t, etagMatches(`"other", `+etag[2:], etag))
+	assert.True(t, etagMatches("*", etag))
+	assert.False(t, etagMatches("", etag))
+	assert.NotEqual(t, etag, locationsETag(100, "from=2020-06-01T00:00:00"))
+	assert.NotEqual(t, etag, locationsETag(99, "from=2020-06-01T00:00:00&limit=5"))
+}
+
+func streamTestLocations(count int) func(each func(*Location) error) error {
+	return func(each func(*Location) error) error {
+		start := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+		for i := 0; i < count; i++ {
+			location := Location{ID: int64(100 - i), Latitude: 51.75, Longitude: -0.45, DeviceTimestamp: start.Add(-time.Duration(i) * time.Minute)}
+			if err := each(&location); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func streamTestRequest(acceptEncoding string, limit int, stream func(each func(*Location) error) error) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/locations", func(c *gin.Context) {
+		writeOTLocations(c, limit, stream)
+	})
+	request, _ := http.NewRequest("GET", "/locations", nil)
+	request.Header.Set("Accept-Encoding", acceptEncoding)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+type streamTestResponse struct {
+	Data []OTPos `json:"data"`
+	Next string  `json:"next"`
+}
+
+func TestWriteOTLocationsPagesWithACursor(t *testing.T) {
+	response := streamTestRequest("", 2, streamTestLocations(3))
+	assert.Equal(t, 200, response.Code)
+	var body streamTestResponse
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Len(t, body.Data, 2)
+	next, err := parseLocationCursor(body.Next)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(99), next.ID)
+	assert.True(t, next.DeviceTimestamp.Equal(time.Date(2020, 6, 1, 8, 59, 0, 0, time.UTC)))
+
+	response = streamTestRequest("", 3, streamTestLocations(3))
+	body = streamTestResponse{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Len(t, body.Data, 3)
+	assert.Equal(t, "", body.Next)
+}
+
+func TestWriteOTLocationsGzips(t *testing.T) {
+	response := streamTestRequest("gzip, deflate", 0, streamTestLocations(0))
+	assert.Equal(t, "gzip", response.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(response.Body)
+	assert.Nil(t, err)
+	plain, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"data":[]}`, string(plain))
+}
+
+func TestWriteOTLocationsReportsEarlyErrors(t *testing.T) {
+	response := streamTestRequest("", 0, func(each func(*Location) error) error {
+		return errors.New("no database")
+	})
+	assert.Equal(t, 500, response.Code)
+	assert.Equal(t, "no database", response.Body.String())
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,3 +30,32 @@ func TestLocationConvertsToOTLoc(t *testing.T) {
 		Addr: "",
 	})
 }
+
+func TestDevicesOnlySeeTheirOwnUserAndFriends(t *testing.T) {
+	devices := []OwntracksHTTPDevice{
+		{User: "growse", Device: "nexus5", Password: "parp", Friends: []string{"alice"}},
+		{User: "growse", Device: "pixel", Password: "parp"},
+	}
+	assert.Equal(t, map[string]bool{"growse": true, "alice": true}, friendUsers(devices, "growse", "nexus5"))
+	assert.Equal(t, map[string]bool{"growse": true}, friendUsers(devices, "growse", "pixel"))
+	assert.Equal(t, map[string]bool{"bob": true}, friendUsers(devices, "bob", "phone"))
+}
+
+func TestRecorderListGoesFromUsersToDevicesToMonthlyRecFiles(t *testing.T) {
+	query, args := recorderListQuery("", "nexus5")
+	assert.Equal(t, "select distinct username from locations order by username", query)
+	assert.Empty(t, args)
+	query, args = recorderListQuery("growse", "")
+	assert.Equal(t, "select distinct device from locations where username=$1 order by device", query)
+	assert.Equal(t, []interface{}{"growse"}, args)
+	query, args = recorderListQuery("growse", "nexus5")
+	assert.Equal(t, "select distinct to_char(devicetimestamp at time zone 'UTC', 'YYYY-MM') || '.rec' as month from locations "+
+		"where username=$1 and device=$2 order by month", query)
+	assert.Equal(t, []interface{}{"growse", "nexus5"}, args)
+}
+
+func TestUserDeviceFilterNumbersItsPlaceholders(t *testing.T) {
+	assert.Equal(t, "($1 = '' or username = $1) and ($2 = '' or device = $2) ", userDeviceFilter(1))
+	assert.Equal(t, "($3 = '' or username = $3) and ($4 = '' or device = $4) ", userDeviceFilter(3))
+	assert.True(t, strings.HasSuffix(lastLocationsQuery, "and ($1 = '' or username = $1) and ($2 = '' or device = $2) order by username, device, devicetimestamp desc"))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/martinlindhe/unit"
+	"time"
+)
+
+/*
+The journey between two consecutive visits. Distance is in metres and speeds in km/h, as in the locations API
+*/
+type Trip struct {
+	User            string        `json:"username"`
+	Device          string        `json:"device"`
+	Start           time.Time     `json:"start"`
+	End             time.Time     `json:"end"`
+	From            string        `json:"from"`
+	To              string        `json:"to"`
+	Distance        float64       `json:"distance"`
+	Duration        time.Duration `json:"-"`
+	DurationSeconds int64         `json:"duration"`
+	AverageSpeed    float64       `json:"averageSpeed"`
+	MaxSpeed        float64       `json:"maxSpeed"`
+	PointCount      int           `json:"count"`
+	Mode            string        `json:"mode"`
+}
+
+func (trip *Trip) DistanceInMiles() float64 {
+	return (unit.Length(trip.Distance) * unit.Meter).Miles()
+}
+
+func (trip *Trip) AverageMph() float64 {
+	return (unit.Speed(trip.AverageSpeed) * unit.KilometersPerHour).MilesPerHour()
+}
+
+func (trip *Trip) MaxMph() float64 {
+	return (unit.Speed(trip.MaxSpeed) * unit.KilometersPerHour).MilesPerHour()
+}
+
+/*
+Best guess at how we travelled, from the speeds in km/h. Average speed does most of the work, as a single bad fix can
+make the maximum speed nonsense
+*/
+func InferTripMode(distance float64, averageSpeed float64, maxSpeed float64) string {
+	switch {
+	case averageSpeed >= 150 || (maxSpeed >= 250 && distance >= 100000):
+		return "flying"
+	case averageSpeed < 7 && maxSpeed < 12:
+		return "walking"
+	case averageSpeed < 25 && maxSpeed < 45:
+		return "cycling"
+	}
+	return "driving"
+}
+
+func GetTripsBetweenDates(from time.Time, to time.Time, user string, device string) ([]Trip, error) {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	query := "with trips as (" +
+		"select username, device, departure as starttime, " +
+		"lead(arrival) over visitorder as endtime, " +
+		"coalesce(geocoding::text, '') as fromgeocoding, " +
+		"coalesce(lead(geocoding::text) over visitorder, '') as togeocoding " +
+		"from visits where ($3 = '' or username = $3) and ($4 = '' or device = $4) " +
+		"window visitorder as (partition by username, device order by arrival)" +
+		") " +
+		"select trips.username, trips.device, starttime, endtime, fromgeocoding, togeocoding, " +
+		"distance, maxspeed, points " +
+		"from trips cross join lateral (" +
+		"select coalesce(sum(segment), 0) as distance, coalesce(max(speed), 0) as maxspeed, count(*) as points from (" +
+		"select ST_Distance(point, lag(point, 1, point) over pointorder) as segment, " +
+		"coalesce(speed, 3.6*ST_Distance(point, lag(point, 1, point) over pointorder)/" +
+		"nullif(extract('epoch' from (devicetimestamp - lag(devicetimestamp) over pointorder)), 0)) as speed " +
+		"from locations where locations.username = trips.username and locations.device = trips.device " +
+		"and devicetimestamp between trips.starttime and trips.endtime and not excluded " +
+		"window pointorder as (order by devicetimestamp)" +
+		") segments" +
+		") stats " +
+		"where endtime is not null and endtime >= $1 and starttime < $2 " +
+		"order by starttime desc"
+	rows, err := db.Query(query, from, to, user, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	trips := []Trip{}
+	for rows.Next() {
+		var trip Trip
+		var fromGeocoding, toGeocoding string
+		err = rows.Scan(&trip.User, &trip.Device, &trip.Start, &trip.End, &fromGeocoding, &toGeocoding,
+			&trip.Distance, &trip.MaxSpeed, &trip.PointCount)
+		if err != nil {
+			return nil, err
+		}
+		trip.From = visitName(fromGeocoding)
+		trip.To = visitName(toGeocoding)
+		trip.Duration = trip.End.Sub(trip.Start)
+		trip.DurationSeconds = int64(trip.Duration.Seconds())
+		if trip.Duration > 0 {
+			trip.AverageSpeed = 3.6 * trip.Distance / trip.Duration.Seconds()
+		}
+		trip.Mode = InferTripMode(trip.Distance, trip.AverageSpeed, trip.MaxSpeed)
+		trips = append(trips, trip)
+	}
+	return trips, rows.Err()
+}
+
+func visitName(geocoding string) string {
+	if geocoding == "" {
+		return ""
+	}
+	location := Location{Geocoding: geocoding}
+	return location.Name()
+}
+
+func OTTripsHandler(c *gin.Context) {
+	const iso8061fmt = "2006-01-02T15:04:05"
+	from := c.DefaultQuery("from", time.Now().AddDate(0, 0, -7).Format(iso8061fmt))
+	to := c.DefaultQuery("to", time.Now().Format(iso8061fmt))
+	fromTime, err := time.Parse(iso8061fmt, from)
+	if err != nil {
+		c.String(500, fmt.Sprintf("Invalid from time %v: %v", from, err))
+		return
+	}
+	toTime, err := time.Parse(iso8061fmt, to)
+	if err != nil {
+		c.String(500, fmt.Sprintf("Invalid to time %v: %v", to, err))
+		return
+	}
+	trips, err := GetTripsBetweenDates(fromTime, toTime, c.Query("user"), c.Query("device"))
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"data": trips})
+}
+
+func TripsHandler(c *gin.Context) {
+	trips, err := GetTripsBetweenDates(time.Now().AddDate(0, 0, -7), time.Now(), c.Query("user"), c.Query("device"))
+	if err != nil {
+		InternalError(err)
+		c.String(500, err.Error())
+		c.Abort()
+		return
+	}
+	c.HTML(200, "trips", gin.H{"results": trips})
+}
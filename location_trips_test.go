@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTripModeIsInferredFromSpeeds(t *testing.T) {
+	assert.Equal(t, "walking", InferTripMode(2000, 4.8, 7))
+	assert.Equal(t, "cycling", InferTripMode(15000, 18, 38))
+	assert.Equal(t, "driving", InferTripMode(40000, 60, 110))
+	assert.Equal(t, "driving", InferTripMode(3000, 5, 50))
+	assert.Equal(t, "flying", InferTripMode(900000, 600, 850))
+	assert.Equal(t, "flying", InferTripMode(300000, 120, 800))
+}
+
+func TestTripSpeedsConvertToMiles(t *testing.T) {
+	trip := Trip{Distance: 1609.344, AverageSpeed: 1.609344, MaxSpeed: 16.09344}
+	assert.InDelta(t, 1, trip.DistanceInMiles(), 0.0001)
+	assert.InDelta(t, 1, trip.AverageMph(), 0.001)
+	assert.InDelta(t, 10, trip.MaxMph(), 0.01)
+}
+
+func TestTripsTemplateRenders(t *testing.T) {
+	start := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+	trips := []Trip{{From: "Hemel Hempstead", To: "London", Start: start, End: start.Add(time.Hour), Duration: time.Hour, Distance: 40000, AverageSpeed: 40, Mode: "driving"}}
+	var output bytes.Buffer
+	err := BuildTemplates().ExecuteTemplate(&output, "trips", map[string]interface{}{"results": trips})
+	assert.Nil(t, err)
+	assert.Contains(t, output.String(), "24.9 miles")
+	assert.Contains(t, output.String(), "driving")
+}
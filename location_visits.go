@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+Somewhere we stayed: a run of consecutive fixes that stay within a distance of the first one for at least a minimum
+duration. Open stays run up to the last fix we have, so may still grow
+*/
+type StayPoint struct {
+	Arrival    time.Time
+	Departure  time.Time
+	Latitude   float64
+	Longitude  float64
+	PointCount int
+	Open       bool
+}
+
+/*
+Stay point detection over fixes in time order. Also returns the index of the first fix of the trailing run, which is
+where detection needs to resume once more fixes arrive
+*/
+func DetectStayPoints(points []Location, maxDistance float64, minDuration time.Duration) ([]StayPoint, int) {
+	var stays []StayPoint
+	i := 0
+	for i < len(points) {
+		j := i + 1
+		for j < len(points) && haversineDistance(points[i].Latitude, points[i].Longitude, points[j].Latitude, points[j].Longitude) <= maxDistance {
+			j++
+		}
+		open := j == len(points)
+		stayed := points[j-1].DeviceTimestamp.Sub(points[i].DeviceTimestamp) >= minDuration
+		if stayed {
+			stays = append(stays, stayPointFromRun(points[i:j], open))
+		}
+		if open {
+			return stays, i
+		}
+		if stayed {
+			i = j
+		} else {
+			i++
+		}
+	}
+	return stays, len(points)
+}
+
+func stayPointFromRun(run []Location, open bool) StayPoint {
+	stay := StayPoint{
+		Arrival:    run[0].DeviceTimestamp,
+		Departure:  run[len(run)-1].DeviceTimestamp,
+		PointCount: len(run),
+		Open:       open,
+	}
+	for _, point := range run {
+		stay.Latitude += point.Latitude
+		stay.Longitude += point.Longitude
+	}
+	stay.Latitude /= float64(len(run))
+	stay.Longitude /= float64(len(run))
+	return stay
+}
+
+type Visit struct {
+	ID         int64     `json:"id"`
+	User       string    `json:"username"`
+	Device     string    `json:"device"`
+	Arrival    time.Time `json:"arrival"`
+	Departure  time.Time `json:"departure"`
+	Latitude   float64   `json:"lat"`
+	Longitude  float64   `json:"lon"`
+	PointCount int       `json:"count"`
+	Name       string    `json:"name"`
+	Address    string    `json:"addr"`
+}
+
+func (visit *Visit) Duration() time.Duration {
+	return visit.Departure.Sub(visit.Arrival).Round(time.Minute)
+}
+
+type deviceKey struct {
+	User   string
+	Device string
+}
+
+/*
+Keeps the visits table up to date. Inserting a location marks its device dirty, and a worker re-runs detection for
+dirty devices from the start of their latest visit
+*/
+type VisitDetector struct {
+	mutex       sync.Mutex
+	dirty       map[deviceKey]bool
+	wake        chan bool
+	maxDistance float64
+	minDuration time.Duration
+	batchSize   int
+}
+
+func NewVisitDetector(maxDistance float64, minDuration time.Duration) *VisitDetector {
+	return &VisitDetector{
+		dirty:       make(map[deviceKey]bool),
+		wake:        make(chan bool, 1),
+		maxDistance: maxDistance,
+		minDuration: minDuration,
+		batchSize:   10000,
+	}
+}
+
+/*
+Mark a device as needing its visits rebuilt. Never blocks
+*/
+func (detector *VisitDetector) Touch(user string, device string) {
+	if detector == nil {
+		return
+	}
+	detector.mutex.Lock()
+	detector.dirty[deviceKey{User: user, Device: device}] = true
+	detector.mutex.Unlock()
+	select {
+	case detector.wake <- true:
+	default:
+	}
+}
+
+func (detector *VisitDetector) takeDirty() []deviceKey {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	var devices []deviceKey
+	for device := range detector.dirty {
+		devices = append(devices, device)
+	}
+	detector.dirty = make(map[deviceKey]bool)
+	return devices
+}
+
+func (detector *VisitDetector) Run(quit <-chan bool) {
+	log.Print("Starting visit detector")
+	// Catch up with anything stored while we weren't running
+	devices, err := getAllDevices()
+	if err != nil {
+		log.Printf("Error fetching devices for visit detection: %v", err)
+	}
+	for _, device := range devices {
+		detector.Touch(device.User, device.Device)
+	}
+	for {
+		select {
+		case <-detector.wake:
+			for _, device := range detector.takeDirty() {
+				err := detector.rebuild(device.User, device.Device)
+				if err != nil {
+					log.Printf("Error detecting visits for %v/%v: %v", device.User, device.Device, err)
+				}
+				select {
+				case <-quit:
+					log.Print("Got signal, quitting visit detector.")
+					return
+				default:
+				}
+			}
+		case <-quit:
+			log.Print("Got signal, quitting visit detector.")
+			return
+		}
+	}
+}
+
+func getAllDevices() ([]deviceKey, error) {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	rows, err := db.Query("select distinct username, device from locations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var devices []deviceKey
+	for rows.Next() {
+		var device deviceKey
+		err = rows.Scan(&device.User, &device.Device)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+/*
+Re-detect visits for the device from the arrival of its latest visit, which may have been open, onwards
+*/
+func (detector *VisitDetector) rebuild(user string, device string) error {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return errors.New("No database connection available")
+	}
+	var latestArrival pq.NullTime
+	err := db.QueryRow("select max(arrival) from visits where username=$1 and device=$2", user, device).Scan(&latestArrival)
+	if err != nil {
+		return err
+	}
+	// With no visits yet, start from the device's first fix
+	from := latestArrival.Time
+	batchSize := detector.batchSize
+	for {
+		points, err := getDevicePointsSince(user, device, from, batchSize)
+		if err != nil {
+			return err
+		}
+		final := len(points) < batchSize
+		stays, resume := DetectStayPoints(points, detector.maxDistance, detector.minDuration)
+		if !final {
+			if resume == 0 {
+				// One stay covers the whole batch, so we need a bigger batch to find where it ends
+				batchSize *= 2
+				continue
+			}
+			if len(stays) > 0 && stays[len(stays)-1].Open {
+				stays = stays[:len(stays)-1]
+			}
+		}
+		err = replaceVisits(user, device, from, stays)
+		if err != nil {
+			return err
+		}
+		if final {
+			break
+		}
+		from = points[resume].DeviceTimestamp
+	}
+	return queueVisitGeocoding(user, device)
+}
+
+func getDevicePointsSince(user string, device string, from time.Time, limit int) ([]Location, error) {
+	defer timeTrack(time.Now())
+	var rows, err = db.Query("select devicetimestamp, ST_Y(point::geometry), ST_X(point::geometry) from locations "+
+		"where username=$1 and device=$2 and devicetimestamp >= $3 and not excluded order by devicetimestamp limit $4", user, device, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var points []Location
+	for rows.Next() {
+		var point Location
+		err = rows.Scan(&point.DeviceTimestamp, &point.Latitude, &point.Longitude)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+/*
+Swap the device's visits from the given time onwards for the newly detected ones. A visit takes the geocoding of its
+closest already geocoded fix, if there is one
+*/
+func replaceVisits(user string, device string, from time.Time, stays []StayPoint) error {
+	defer timeTrack(time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from visits where username=$1 and device=$2 and arrival >= $3", user, device, from)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, stay := range stays {
+		_, err = tx.Exec("insert into visits (username, device, arrival, departure, point, pointcount, geocoding) "+
+			"values ($1, $2, $3, $4, ST_SetSRID(ST_Point($5, $6), 4326), $7, "+
+			"(select geocoding from locations where username=$1 and device=$2 and devicetimestamp between $3 and $4 "+
+			"and geocoding is not null and not excluded order by point <-> ST_SetSRID(ST_Point($5, $6), 4326)::geography limit 1)) "+
+			"on conflict (username, device, arrival) do update set departure=excluded.departure, point=excluded.point, "+
+			"pointcount=excluded.pointcount, geocoding=coalesce(excluded.geocoding, visits.geocoding)",
+			user, device, stay.Arrival, stay.Departure, stay.Longitude, stay.Latitude, stay.PointCount)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+Queue reverse geocoding for any of the device's visits that none of their fixes could name. The geocoding workers do
+the rate limited part, so detection for other devices doesn't wait on it
+*/
+func queueVisitGeocoding(user string, device string) error {
+	if GeocodingWorkQueue == nil || reverseGeocoder == nil {
+		return nil
+	}
+	rows, err := db.Query("select id from visits where username=$1 and device=$2 and geocoding is null", user, device)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+		GeocodingWorkQueue.EnqueueVisit(id)
+	}
+	return rows.Err()
+}
+
+/*
+Reverse geocode a single visit and store the result against it
+*/
+func UpdateVisitWithGeocoding(id int64) error {
+	if db == nil {
+		return errors.New("No database connection available")
+	}
+	var location Location
+	err := db.QueryRow("select ST_Y(point::geometry), ST_X(point::geometry) from visits where id=$1", id).Scan(&location.Latitude, &location.Longitude)
+	if err == sql.ErrNoRows {
+		// Replaced by a later rebuild, which queues its own visits
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	geocoding, err := location.GetReverseGeocoding()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("update visits set geocoding=$1 where id=$2", geocoding, id)
+	return err
+}
+
+func GetVisitsBetweenDates(from time.Time, to time.Time, user string, device string) ([]Visit, error) {
+	defer timeTrack(time.Now())
+	if db == nil {
+		return nil, errors.New("No database connection available")
+	}
+	rows, err := db.Query("select id, username, device, arrival, departure, ST_Y(point::geometry), ST_X(point::geometry), "+
+		"pointcount, coalesce(geocoding::text, ''), "+
+		"coalesce(geocoding ->> 'formatted_address', geocoding -> 'results' -> 0 ->> 'formatted_address', '') "+
+		"from visits where departure >= $1 and arrival <= $2 and ($3='' or username=$3) and ($4='' or device=$4) "+
+		"order by arrival desc", from, to, user, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	visits := []Visit{}
+	for rows.Next() {
+		var visit Visit
+		var geocoding string
+		err = rows.Scan(&visit.ID, &visit.User, &visit.Device, &visit.Arrival, &visit.Departure, &visit.Latitude,
+			&visit.Longitude, &visit.PointCount, &geocoding, &visit.Address)
+		if err != nil {
+			return nil, err
+		}
+		visit.Name = visitName(geocoding)
+		visits = append(visits, visit)
+	}
+	return visits, rows.Err()
+}
+
+func OTVisitsHandler(c *gin.Context) {
+	const iso8061fmt = "2006-01-02T15:04:05"
+	from := c.DefaultQuery("from", time.Now().AddDate(0, 0, -7).Format(iso8061fmt))
+	to := c.DefaultQuery("to", time.Now().Format(iso8061fmt))
+	fromTime, err := time.Parse(iso8061fmt, from)
+	if err != nil {
+		c.String(500, fmt.Sprintf("Invalid from time %v: %v", from, err))
+		return
+	}
+	toTime, err := time.Parse(iso8061fmt, to)
+	if err != nil {
+		c.String(500, fmt.Sprintf("Invalid to time %v: %v", to, err))
+		return
+	}
+	visits, err := GetVisitsBetweenDates(fromTime, toTime, c.Query("user"), c.Query("device"))
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"data": visits})
+}
+
+/*
+Where have I been this week
+*/
+func VisitsHandler(c *gin.Context) {
+	visits, err := GetVisitsBetweenDates(time.Now().AddDate(0, 0, -7), time.Now(), c.Query("user"), c.Query("device"))
+	if err != nil {
+		InternalError(err)
+		c.String(500, err.Error())
+		c.Abort()
+		return
+	}
+	c.HTML(200, "visits", gin.H{"results": visits})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func stayTestTrack(start time.Time, positions ...[2]float64) []Location {
+	points := make([]Location, len(positions))
+	for i, position := range positions {
+		points[i] = Location{Latitude: position[0], Longitude: position[1], DeviceTimestamp: start.Add(time.Duration(i) * 5 * time.Minute)}
+	}
+	return points
+}
+
+func TestStayPointsAreDetectedBetweenMovement(t *testing.T) {
+	start := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+	home := [2]float64{51.7472, -0.4734}
+	nearHome := [2]float64{51.7473, -0.4736}
+	road := [2]float64{51.7600, -0.4500}
+	work := [2]float64{51.7800, -0.4000}
+	points := stayTestTrack(start, home, nearHome, home, nearHome, road, work, work, work, work, [2]float64{51.8, -0.3})
+	stays, resume := DetectStayPoints(points, 200, 10*time.Minute)
+	assert.Len(t, stays, 2)
+	assert.Equal(t, start, stays[0].Arrival)
+	assert.Equal(t, start.Add(15*time.Minute), stays[0].Departure)
+	assert.Equal(t, 4, stays[0].PointCount)
+	assert.InDelta(t, 51.74725, stays[0].Latitude, 0.00001)
+	assert.False(t, stays[0].Open)
+	assert.Equal(t, start.Add(25*time.Minute), stays[1].Arrival)
+	assert.Equal(t, 4, stays[1].PointCount)
+	assert.Equal(t, 9, resume)
+}
+
+func TestShortStopsAreNotStays(t *testing.T) {
+	start := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+	stays, _ := DetectStayPoints(stayTestTrack(start, [2]float64{51.7472, -0.4734}, [2]float64{51.7472, -0.4734}, [2]float64{51.8, -0.3}), 200, 10*time.Minute)
+	assert.Empty(t, stays)
+}
+
+func TestTrailingStayIsOpen(t *testing.T) {
+	start := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+	home := [2]float64{51.7472, -0.4734}
+	stays, resume := DetectStayPoints(stayTestTrack(start, [2]float64{51.8, -0.3}, home, home, home), 200, 10*time.Minute)
+	assert.Len(t, stays, 1)
+	assert.True(t, stays[0].Open)
+	assert.Equal(t, 1, resume)
+}
+
+func TestNoPointsNoStays(t *testing.T) {
+	stays, resume := DetectStayPoints(nil, 200, 10*time.Minute)
+	assert.Empty(t, stays)
+	assert.Equal(t, 0, resume)
+}
+
+func TestVisitsTemplateRenders(t *testing.T) {
+	arrival := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+	visits := []Visit{{User: "growse", Device: "nexus5", Arrival: arrival, Departure: arrival.Add(90 * time.Minute), Name: "Hemel Hempstead"}}
+	var output bytes.Buffer
+	err := BuildTemplates().ExecuteTemplate(&output, "visits", map[string]interface{}{"results": visits})
+	assert.Nil(t, err)
+	assert.Contains(t, output.String(), "Hemel Hempstead")
+	assert.Contains(t, output.String(), "1h30m0s")
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = (wsPongWait * 9) / 10
+	wsMaxMessageSize = 512
+	wsSendBufferSize = 16
+)
+
+var wsupgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     allowedWebsocketOrigin,
+}
+
+/*
+The socket is authenticated by cookie, so a page on any other site could otherwise open it as the visitor and read
+everyone's locations. Browsers always send an Origin, so a missing one is a non-browser client with its own cookie
+*/
+func allowedWebsocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	// The auth cookie is set for the domain, so its subdomains are ours too
+	domain := strings.ToLower(configuration.Domain)
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+/*
+Fans out new locations to every connected websocket client. Only Run sends to or closes a client's send channel, so
+anything else wanting to talk to one client goes through direct
+*/
+type LocationHub struct {
+	clients    map[*wsClient]bool
+	broadcast  chan []byte
+	direct     chan wsDirectMessage
+	register   chan *wsClient
+	unregister chan *wsClient
+	done       chan struct{}
+}
+
+type wsDirectMessage struct {
+	client  *wsClient
+	message []byte
+}
+
+type wsClient struct {
+	hub  *LocationHub
+	conn *websocket.Conn
+	send chan []byte
+}
+
+func NewLocationHub() *LocationHub {
+	return &LocationHub{
+		clients:    make(map[*wsClient]bool),
+		broadcast:  make(chan []byte, 100),
+		direct:     make(chan wsDirectMessage),
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		done:       make(chan struct{}),
+	}
+}
+
+func (hub *LocationHub) Run(quit <-chan bool) {
+	log.Print("Starting websocket hub")
+	// Once we're gone nobody's reading register, unregister or direct, so they mustn't wait for us
+	defer close(hub.done)
+	for {
+		select {
+		case client := <-hub.register:
+			hub.clients[client] = true
+			log.Printf("Websocket client connected. %d clients", len(hub.clients))
+		case client := <-hub.unregister:
+			if _, ok := hub.clients[client]; ok {
+				delete(hub.clients, client)
+				close(client.send)
+				log.Printf("Websocket client disconnected. %d clients", len(hub.clients))
+			}
+		case direct := <-hub.direct:
+			if _, ok := hub.clients[direct.client]; ok {
+				select {
+				case direct.client.send <- direct.message:
+				default:
+					log.Print("Websocket client send queue full, dropping message")
+				}
+			}
+		case message := <-hub.broadcast:
+			for client := range hub.clients {
+				select {
+				case client.send <- message:
+				default:
+					// Client can't keep up, so drop it rather than block everyone else
+					delete(hub.clients, client)
+					close(client.send)
+				}
+			}
+		case <-quit:
+			for client := range hub.clients {
+				delete(hub.clients, client)
+				close(client.send)
+			}
+			log.Print("Quitting websocket hub")
+			return
+		}
+	}
+}
+
+/*
+Queue a location for every client. Never blocks the caller, which is usually the MQTT handler
+*/
+func (hub *LocationHub) Publish(position OTPos) {
+	if hub == nil {
+		return
+	}
+	message, err := json.Marshal(position)
+	if err != nil {
+		log.Printf("Error formatting location for websocket: %v", err)
+		return
+	}
+	select {
+	case hub.broadcast <- message:
+	default:
+		log.Print("Websocket broadcast queue full, dropping location")
+	}
+}
+
+/*
+False if the hub has stopped, in which case the client should go away
+*/
+func (hub *LocationHub) registerClient(client *wsClient) bool {
+	select {
+	case hub.register <- client:
+		return true
+	case <-hub.done:
+		return false
+	}
+}
+
+func (hub *LocationHub) unregisterClient(client *wsClient) {
+	select {
+	case hub.unregister <- client:
+	case <-hub.done:
+	}
+}
+
+/*
+Send one client a message via the hub, which knows whether its send channel is still open
+*/
+func (hub *LocationHub) sendTo(client *wsClient, message []byte) bool {
+	select {
+	case hub.direct <- wsDirectMessage{client: client, message: message}:
+		return true
+	case <-hub.done:
+		return false
+	}
+}
+
+func (client *wsClient) readPump() {
+	defer func() {
+		client.hub.unregisterClient(client)
+		client.conn.Close()
+	}()
+	client.conn.SetReadLimit(wsMaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	client.conn.SetPongHandler(func(string) error {
+		client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+	for {
+		_, msg, err := client.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Websocket read error: %v", err)
+			}
+			return
+		}
+		switch string(msg) {
+		case "LAST":
+			client.sendLastLocations()
+		default:
+			break
+		}
+	}
+}
+
+func (client *wsClient) sendLastLocations() {
+	locations, err := GetLastLocations("", "")
+	if err != nil {
+		log.Printf("Error fetching last location: %v", err)
+		return
+	}
+	for _, location := range *locations {
+		locationAsBytes, err := json.Marshal(location.toOT())
+		if err != nil {
+			log.Printf("Error formatting location for websocket: %v", err)
+			return
+		}
+		if !client.hub.sendTo(client, locationAsBytes) {
+			return
+		}
+	}
+}
+
+func (client *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func wshandler(hub *LocationHub, w http.ResponseWriter, r *http.Request) {
+	conn, err := wsupgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to set websocket upgrade: %+v\n", err)
+		return
+	}
+	client := &wsClient{hub: hub, conn: conn, send: make(chan []byte, wsSendBufferSize)}
+	if !hub.registerClient(client) {
+		conn.Close()
+		return
+	}
+
+	go client.writePump()
+	go client.readPump()
+}
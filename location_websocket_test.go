@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishedLocationIsPushedToConnectedWebsocketClients(t *testing.T) {
+	hub := NewLocationHub()
+	quit := make(chan bool)
+	defer close(quit)
+	go hub.Run(quit)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wshandler(hub, w, r)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// Registration is asynchronous, so keep publishing until the client sees something
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make(chan []byte)
+	go func() {
+		_, msg, err := conn.ReadMessage()
+		if err == nil {
+			received <- msg
+		}
+		close(received)
+	}()
+	position := OTPos{Tst: 1265169906, Type: "location", Lat: 15, Lon: 20, User: "growse", Dev: "nexus5"}
+	var msg []byte
+	for msg == nil {
+		hub.Publish(position)
+		select {
+		case msg = <-received:
+			if msg == nil {
+				t.Fatal("Websocket closed without receiving a location")
+			}
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	var actual OTPos
+	assert.Nil(t, json.Unmarshal(msg, &actual))
+	assert.Equal(t, position, actual)
+}
+
+func TestPublishingToANilHubDoesNothing(t *testing.T) {
+	var hub *LocationHub
+	hub.Publish(OTPos{})
+}
+
+func TestHubDoesNotBlockOrPanicOnceStopped(t *testing.T) {
+	hub := NewLocationHub()
+	quit := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		hub.Run(quit)
+		close(stopped)
+	}()
+	client := &wsClient{hub: hub, send: make(chan []byte, wsSendBufferSize)}
+	assert.True(t, hub.registerClient(client))
+	close(quit)
+	<-stopped
+
+	_, open := <-client.send
+	assert.False(t, open)
+	assert.False(t, hub.sendTo(client, []byte("{}")))
+	assert.False(t, hub.registerClient(&wsClient{hub: hub, send: make(chan []byte)}))
+	hub.unregisterClient(client)
+}
+
+func TestHubIgnoresDirectMessagesForDroppedClients(t *testing.T) {
+	hub := NewLocationHub()
+	quit := make(chan bool)
+	defer close(quit)
+	go hub.Run(quit)
+	client := &wsClient{hub: hub, send: make(chan []byte, wsSendBufferSize)}
+	assert.True(t, hub.registerClient(client))
+	hub.unregisterClient(client)
+	assert.True(t, hub.sendTo(client, []byte("{}")))
+	_, open := <-client.send
+	assert.False(t, open)
+}
+
+func TestWebsocketOnlyAcceptsOurOwnOrigins(t *testing.T) {
+	previous := configuration.Domain
+	configuration.Domain = "growse.com"
+	defer func() { configuration.Domain = previous }()
+	request := func(origin string) *http.Request {
+		r := httptest.NewRequest("GET", "http://www.growse.com/where/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+	assert.True(t, allowedWebsocketOrigin(request("")))
+	assert.True(t, allowedWebsocketOrigin(request("https://www.growse.com")))
+	assert.True(t, allowedWebsocketOrigin(request("https://growse.com")))
+	assert.True(t, allowedWebsocketOrigin(request("https://locations.growse.com")))
+	assert.False(t, allowedWebsocketOrigin(request("https://evil.example")))
+	assert.False(t, allowedWebsocketOrigin(request("https://notgrowse.com")))
+	assert.False(t, allowedWebsocketOrigin(request("https://growse.com.evil.example")))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 	_ "time"
@@ -40,10 +41,23 @@ func BuildRoutes(router *gin.Engine) {
 			c.HTML(200, "place", nil)
 		})
 		authorized.POST("place/", PlaceHandler)
+		authorized.GET("visits/", VisitsHandler)
+		authorized.GET("trips/", TripsHandler)
 		authorized.GET("ui/config/config.js", func(c *gin.Context) {
 			c.Data(200, "text/javascript", []byte(owntracksFrontendConfig))
 		})
 
+		adminAPI := authorized.Group("admin")
+		{
+			adminAPI.GET("geocoding", GeocodingBackfillStatusHandler)
+			adminAPI.POST("geocoding/start", GeocodingBackfillStartHandler)
+			adminAPI.POST("geocoding/stop", GeocodingBackfillStopHandler)
+			adminAPI.POST("import", ImportHandler)
+			adminAPI.POST("exclusions", ExclusionBackfillHandler)
+			// Counters such as locationInsertResults, which nothing else shows
+			adminAPI.GET("vars", gin.WrapH(expvar.Handler()))
+		}
+
 		otRecorderAPI := authorized.Group("data")
 		{
 			restAPI := otRecorderAPI.Group("api/0")
@@ -52,15 +66,28 @@ func BuildRoutes(router *gin.Engine) {
 				restAPI.GET("last", OTLastPosHandler)
 				restAPI.GET("locations", OTLocationsHandler)
 				restAPI.GET("version", OTVersionHandler)
+				restAPI.GET("transitions", OTTransitionsHandler)
+				restAPI.GET("waypoints", OTWaypointsHandler)
+				restAPI.GET("cards", OTCardsHandler)
+				restAPI.GET("places", OTPlacesHandler)
+				restAPI.GET("visits", OTVisitsHandler)
+				restAPI.GET("trips", OTTripsHandler)
+				restAPI.GET("stats", OTStatsHandler)
+				restAPI.GET("export", OTExportHandler)
 			}
 			wsAPI := otRecorderAPI.Group("ws")
 			{
 				wsAPI.GET("last", func(c *gin.Context) {
-					wshandler(c.Writer, c.Request)
+					if locationHub == nil {
+						c.String(503, "Websocket hub not running")
+						return
+					}
+					wshandler(locationHub, c.Writer, c.Request)
 				})
 			}
 		}
 	}
+	router.POST("/where/pub", DeviceAuthRequired(), OTPubHandler)
 	router.Use(static.ServeRoot("/where/ui/", configuration.OwntracksFrontendDir))
 	router.GET("/oauth2callback", OauthCallback)
 	router.POST("/search/", BleveSearchQuery)
@@ -26,6 +26,8 @@ const (
 <form method="post" class="pure-form">
 <fieldset>
 <input type="text" placeholder="Search for place" name="place" value="{{.place}}">
+<input type="number" placeholder="Radius (m)" name="radius" min="0" value="{{.radius}}">
+<button type="submit" class="pure-button pure-button-primary">Search</button>
 </fieldset>
 </form>
 </div>
@@ -54,6 +56,9 @@ const (
 <tr>
 <th>Date</th>
 <th>Number of locations</th>
+<th>First</th>
+<th>Last</th>
+<th>Dwell</th>
 <th>Link</th>
 </tr>
 
@@ -61,10 +66,95 @@ const (
 <tr>
 <td>{{$result.Date.Format "2 January 2006"}}</td>
 <td>{{$result.LocationCount}}</td>
+<td>{{$result.FirstVisit.Format "15:04"}}</td>
+<td>{{$result.LastVisit.Format "15:04"}}</td>
+<td>{{$result.Dwell}}</td>
 <td><a href="/where/ui/?start={{$result.Date.Format "2006-01-02"}}T00%3A00%3A00&end={{$result.Date.Format "2006-01-02"}}T23%3A59%3A59&layers=last,line,points" title="Map">Map</a></td>
 </tr>
 {{ else }}
-<tr><td colspan="3">No results</td></tr>
+<tr><td colspan="6">No results</td></tr>
+{{ end }}
+
+</table>
+</div>
+</div>
+{{template "footer"}}
+`
+	visitsTemplate = `{{template "header"}}
+<div class="pure-g">
+<div class="pure-u-1">
+<h1>Where have I been this week?</h1>
+<p><a href="/where/trips/">Trips</a> | <a href="/where/place/">Search for a place</a></p>
+</div>
+</div>
+<div class="pure-g">
+<div class="pure-u-1">
+<table class="pure-table">
+
+<tr>
+<th>Arrived</th>
+<th>Left</th>
+<th>Stayed</th>
+<th>Place</th>
+<th>Device</th>
+<th>Link</th>
+</tr>
+
+{{ range $i, $visit := .results }}
+<tr>
+<td>{{$visit.Arrival.Format "Mon 2 January 15:04"}}</td>
+<td>{{$visit.Departure.Format "Mon 2 January 15:04"}}</td>
+<td>{{$visit.Duration}}</td>
+<td>{{if $visit.Name}}{{$visit.Name}}{{else}}{{printf "%.4f, %.4f" $visit.Latitude $visit.Longitude}}{{end}}</td>
+<td>{{$visit.User}}/{{$visit.Device}}</td>
+<td><a href="/where/ui/?start={{$visit.Arrival.UTC.Format "2006-01-02T15"}}%3A{{$visit.Arrival.UTC.Format "04"}}%3A00&end={{$visit.Departure.UTC.Format "2006-01-02T15"}}%3A{{$visit.Departure.UTC.Format "04"}}%3A59&layers=last,line,points" title="Map">Map</a></td>
+</tr>
+{{ else }}
+<tr><td colspan="6">No visits</td></tr>
+{{ end }}
+
+</table>
+</div>
+</div>
+{{template "footer"}}
+`
+	tripsTemplate = `{{template "header"}}
+<div class="pure-g">
+<div class="pure-u-1">
+<h1>Trips this week</h1>
+<p><a href="/where/visits/">Visits</a> | <a href="/where/place/">Search for a place</a></p>
+</div>
+</div>
+<div class="pure-g">
+<div class="pure-u-1">
+<table class="pure-table">
+
+<tr>
+<th>Left</th>
+<th>From</th>
+<th>To</th>
+<th>Took</th>
+<th>Distance</th>
+<th>Average</th>
+<th>Max</th>
+<th>Mode</th>
+<th>Link</th>
+</tr>
+
+{{ range $i, $trip := .results }}
+<tr>
+<td>{{$trip.Start.Format "Mon 2 January 15:04"}}</td>
+<td>{{$trip.From}}</td>
+<td>{{$trip.To}}</td>
+<td>{{$trip.Duration}}</td>
+<td>{{printf "%.1f miles" $trip.DistanceInMiles}}</td>
+<td>{{printf "%.0f mph" $trip.AverageMph}}</td>
+<td>{{printf "%.0f mph" $trip.MaxMph}}</td>
+<td>{{$trip.Mode}}</td>
+<td><a href="/where/ui/?start={{$trip.Start.UTC.Format "2006-01-02T15"}}%3A{{$trip.Start.UTC.Format "04"}}%3A00&end={{$trip.End.UTC.Format "2006-01-02T15"}}%3A{{$trip.End.UTC.Format "04"}}%3A59&layers=last,line,points" title="Map">Map</a></td>
+</tr>
+{{ else }}
+<tr><td colspan="9">No trips</td></tr>
 {{ end }}
 
 </table>
@@ -77,6 +167,8 @@ const (
 func BuildTemplates() *template.Template {
 	t := template.Must(template.New("place").Parse(placeTemplate))
 	t = template.Must(t.New("placeResults").Parse(placeResultsTemplate))
+	t = template.Must(t.New("visits").Parse(visitsTemplate))
+	t = template.Must(t.New("trips").Parse(tripsTemplate))
 	t = template.Must(t.New("placeResults").Parse(includesTemplate))
 	return t
 }
@@ -23,7 +23,16 @@ var (
 	db                 *sql.DB
 	configuration      Configuration
 	oAuthConf          *oauth2.Config
-	GeocodingWorkQueue chan bool
+	GeocodingWorkQueue *GeocodingQueue
+	locationHub        *LocationHub
+	locationRetryQueue *LocationRetryQueue
+	geocodingBackfill  *GeocodingBackfill
+	visitDetector      *VisitDetector
+	serverQuit         <-chan bool
+
+	reverseGeocodingLimiter *rateLimiter
+	forwardGeocoder         Geocoder
+	reverseGeocoder         Geocoder
 )
 
 func InternalError(err error) {
@@ -51,6 +60,17 @@ func InternalError(err error) {
 func main() {
 	configuration = *getConfiguration()
 
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if configuration.DbHost != "" {
+			var err error
+			db, err = setupDatabase(configuration.DbHost, configuration.DbUser, configuration.DbName)
+			if err != nil {
+				log.Fatalf("Error setting up database")
+			}
+		}
+		os.Exit(runImport(os.Args[2:]))
+	}
+
 	oAuthConf = &oauth2.Config{
 		ClientID:     configuration.ClientID,
 		ClientSecret: configuration.ClientSecret,
@@ -64,6 +84,7 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	quit := make(chan bool, 1)
+	serverQuit = quit
 
 	go func() {
 		for sig := range c {
@@ -71,15 +92,15 @@ func main() {
 			if quit != nil {
 				close(quit)
 			}
-			if GeocodingWorkQueue != nil {
-				close(GeocodingWorkQueue)
-			}
 			log.Print("Closing manners")
 			manners.Close()
 		}
 		log.Print("Quitting signal listener goroutine.")
 	}()
 
+	locationHub = NewLocationHub()
+	go locationHub.Run(quit)
+
 	// Initialize fulltext engine
 	pathPattern, err := regexp.Compile(configuration.SearchPathPattern)
 	if err != nil {
@@ -93,11 +114,42 @@ func main() {
 		if err != nil {
 			log.Fatalf("Error setting up database")
 		}
-		GeocodingWorkQueue = make(chan bool, 100)
-		go UpdateLatestLocationWithGeocoding(GeocodingWorkQueue)
-		if configuration.EnableGeocodingCrawler {
-			go GeocodingCrawler(quit)
+		reverseGeocodingLimiter = newRateLimiter(configuration.GeocodingRateLimit)
+		reverseGeocoder, err = newGeocoder(configuration.ReverseGeocoder, configuration.ReverseGeocodeApiURL, "")
+		if err != nil {
+			log.Printf("Reverse geocoding disabled: %v", err)
+		}
+		if configuration.GeocodingProvider == "offline" && reverseGeocoder != nil && reverseGeocoder.Name() == "offline" {
+			// No point loading the dataset twice
+			forwardGeocoder = reverseGeocoder
+		} else {
+			forwardGeocoder, err = newGeocoder(configuration.GeocodingProvider, "", configuration.GeocodeApiURL)
+			if err != nil {
+				log.Printf("Place search disabled: %v", err)
+			}
+		}
+		GeocodingWorkQueue = NewGeocodingQueue(configuration.GeocodingWorkers, configuration.GeocodingMaxAttempts, 30*time.Second, UpdateLocationWithGeocoding, UpdateVisitWithGeocoding)
+		go GeocodingWorkQueue.Run(quit)
+		geocodingBackfill = NewGeocodingBackfill(GeocodingWorkQueue, quit)
+		if configuration.GeocodingSweepMinutes > 0 {
+			sweep := NewGeocodingBackfill(GeocodingWorkQueue, quit)
+			go sweep.Sweep(time.Duration(configuration.GeocodingSweepMinutes)*time.Minute, geocodingSweepOptions, quit)
+		} else if configuration.EnableGeocodingCrawler {
+			err = geocodingBackfill.Start(defaultGeocodingBackfillOptions())
+			if err != nil {
+				log.Printf("Unable to start geocoding backfill: %v", err)
+			}
+		}
+		if configuration.LocationRetryQueueDir != "" {
+			locationRetryQueue, err = NewLocationRetryQueue(configuration.LocationRetryQueueDir)
+			if err != nil {
+				log.Printf("Unable to create location retry queue, failed inserts will be lost: %v", err)
+			} else {
+				go locationRetryQueue.Run(30*time.Second, quit)
+			}
 		}
+		visitDetector = NewVisitDetector(configuration.VisitMaxDistance, time.Duration(configuration.VisitMinMinutes)*time.Minute)
+		go visitDetector.Run(quit)
 		go SubscribeMQTT(quit)
 		DoDatabaseMigrations(db, configuration.DatabaseMigrationsPath)
 	} else {